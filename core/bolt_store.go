@@ -0,0 +1,761 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"regexp"
+	"sort"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	domainsBucket      = []byte("domains")      // id -> BSON encoded domain
+	namesBucket        = []byte("names")        // name -> id
+	uncheckedBucket    = []byte("unchecked")    // id -> nothing
+	retryBucket        = []byte("retry")        // next attempt + id -> nothing
+	checkedBucket      = []byte("checked")      // last checked + id -> nothing, for recrawlable domains
+	headerValuesBucket = []byte("headervalues") // value or its prefix and hash + 0x00 + id -> nothing
+	observationsBucket = []byte("observations") // domain id + observation id -> BSON encoded observation
+	sitesBucket        = []byte("sites")        // registrable domain -> BSON encoded site
+)
+
+// DomainStore kept in a single BoltDB file. Bolt locks the file so only one
+// process can have it open for writing at a time.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func NewBoltStore(path string, readOnly bool) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	if !readOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			// Files from older versions need the checked index built
+			indexChecked := tx.Bucket(checkedBucket) == nil && tx.Bucket(domainsBucket) != nil
+			for _, name := range [][]byte{domainsBucket, namesBucket, uncheckedBucket, retryBucket, checkedBucket, headerValuesBucket, observationsBucket, sitesBucket} {
+				if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+					return err
+				}
+			}
+			if indexChecked {
+				return tx.Bucket(domainsBucket).ForEach(func(id []byte, data []byte) error {
+					var domain Domain
+					if err := bson.Unmarshal(data, &domain); err != nil {
+						return err
+					}
+					if !isRecrawlable(domain) {
+						return nil
+					}
+					return tx.Bucket(checkedBucket).Put(timeKey(domain.LastChecked, domain.Id), nil)
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func isUnchecked(domain Domain) bool {
+	return domain.CrawlStatus() == StatusUnchecked
+}
+
+func objectIdFromKey(key []byte) primitive.ObjectID {
+	var id primitive.ObjectID
+	copy(id[:], key)
+	return id
+}
+
+// Longer header values only have their start in the index key. Bolt keys
+// can be at most 32 KiB and some Content-Security-Policy headers are longer.
+const maxIndexedHeaderValue = 1024
+
+// Long values end in a hash of the whole value so different values with the
+// same start still get their own key
+func headerValueKey(value string, id primitive.ObjectID) []byte {
+	indexed := value
+	if len(value) > maxIndexedHeaderValue {
+		hash := fnv.New64a()
+		hash.Write([]byte(value))
+		indexed = value[:maxIndexedHeaderValue] + string(hash.Sum(nil))
+	}
+	key := make([]byte, 0, len(indexed)+1+len(id))
+	key = append(key, indexed...)
+	key = append(key, 0)
+	return append(key, id[:]...)
+}
+
+// Split a header value index key back into the value and the domain id.
+// complete is false when the key only holds the start of a long value.
+func splitHeaderValueKey(key []byte) (value string, id primitive.ObjectID, complete bool) {
+	value = string(key[:len(key)-13])
+	return value, objectIdFromKey(key[len(key)-12:]), len(value) <= maxIndexedHeaderValue
+}
+
+// Retry and checked keys sort by time. BSON keeps times to the millisecond
+// so the key of a decoded domain matches the one stored.
+func timeKey(t time.Time, id primitive.ObjectID) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(t.UnixMilli()))
+	return append(key, id[:]...)
+}
+
+func timeKeyBefore(key []byte, t time.Time) bool {
+	return int64(binary.BigEndian.Uint64(key[:8])) <= t.UnixMilli()
+}
+
+func getBoltDomain(tx *bolt.Tx, id primitive.ObjectID) (Domain, error) {
+	var domain Domain
+	data := tx.Bucket(domainsBucket).Get(id[:])
+	if data == nil {
+		return domain, ErrNotFound
+	}
+	err := bson.Unmarshal(data, &domain)
+	return domain, err
+}
+
+func removeBoltIndexes(tx *bolt.Tx, domain Domain) error {
+	if err := tx.Bucket(uncheckedBucket).Delete(domain.Id[:]); err != nil {
+		return err
+	}
+	if domain.Status == StatusRetry {
+		if err := tx.Bucket(retryBucket).Delete(timeKey(domain.NextAttempt, domain.Id)); err != nil {
+			return err
+		}
+	}
+	if isRecrawlable(domain) {
+		if err := tx.Bucket(checkedBucket).Delete(timeKey(domain.LastChecked, domain.Id)); err != nil {
+			return err
+		}
+	}
+	for _, header := range domain.Headers {
+		for _, value := range header.AllValues() {
+			if err := tx.Bucket(headerValuesBucket).Delete(headerValueKey(value, domain.Id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func putBoltDomain(tx *bolt.Tx, domain Domain) error {
+	data, err := bson.Marshal(domain)
+	if err != nil {
+		return err
+	}
+	if err = tx.Bucket(domainsBucket).Put(domain.Id[:], data); err != nil {
+		return err
+	}
+	if err = tx.Bucket(namesBucket).Put([]byte(domain.Name), domain.Id[:]); err != nil {
+		return err
+	}
+	if isUnchecked(domain) {
+		if err = tx.Bucket(uncheckedBucket).Put(domain.Id[:], nil); err != nil {
+			return err
+		}
+	}
+	if domain.Status == StatusRetry {
+		if err = tx.Bucket(retryBucket).Put(timeKey(domain.NextAttempt, domain.Id), nil); err != nil {
+			return err
+		}
+	}
+	if isRecrawlable(domain) {
+		if err = tx.Bucket(checkedBucket).Put(timeKey(domain.LastChecked, domain.Id), nil); err != nil {
+			return err
+		}
+	}
+	for _, header := range domain.Headers {
+		for _, value := range header.AllValues() {
+			if err = tx.Bucket(headerValuesBucket).Put(headerValueKey(value, domain.Id), nil); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (store *BoltStore) GetDomainById(ctx context.Context, id primitive.ObjectID) (Domain, error) {
+	var domain Domain
+	err := store.db.View(func(tx *bolt.Tx) error {
+		var err error
+		domain, err = getBoltDomain(tx, id)
+		return err
+	})
+	return domain, err
+}
+
+func (store *BoltStore) GetDomainByName(ctx context.Context, name string) (Domain, error) {
+	var domain Domain
+	err := store.db.View(func(tx *bolt.Tx) error {
+		id := tx.Bucket(namesBucket).Get([]byte(name))
+		if id == nil {
+			return ErrNotFound
+		}
+		var err error
+		domain, err = getBoltDomain(tx, objectIdFromKey(id))
+		return err
+	})
+	return domain, err
+}
+
+// Add the links to the InDegree and DiscoverySources of the named domain,
+// creating it if it does not exist. Returns whether it was created.
+func upsertBoltLinks(tx *bolt.Tx, name string, links Links) (bool, error) {
+	id := tx.Bucket(namesBucket).Get([]byte(name))
+	if id == nil {
+		domain := Domain{
+			Id:               primitive.NewObjectID(),
+			Name:             name,
+			ParentDomain:     links.Parent,
+			DiscoverySources: links.Sources,
+			Port:             links.Port,
+			InDegree:         links.Count,
+		}
+		domain.DiscoverySource = links.discovery(name).Source
+		domain.RegistrableDomain, _ = RegistrableDomain(name)
+		return true, putBoltDomain(tx, domain)
+	}
+	domain, err := getBoltDomain(tx, objectIdFromKey(id))
+	if err != nil {
+		return false, err
+	}
+	known := Links{Count: domain.InDegree + links.Count, Sources: domain.DiscoverySources}
+	for _, source := range links.Sources {
+		known.AddSource(source)
+	}
+	domain.InDegree = known.Count
+	domain.DiscoverySources = known.Sources
+	return false, putBoltDomain(tx, domain)
+}
+
+func (store *BoltStore) UpsertDiscoveredDomains(ctx context.Context, discoveries []Discovery, parentId primitive.ObjectID) ([]Discovery, error) {
+	var inserted []Discovery
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		inserted = nil
+		for _, discovery := range discoveries {
+			created, err := upsertBoltLinks(tx, discovery.Name, discoveryLinks(discovery, parentId))
+			if err != nil {
+				return err
+			}
+			if created {
+				inserted = append(inserted, discovery)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+func (store *BoltStore) AddLinks(ctx context.Context, links map[string]Links) ([]Discovery, error) {
+	if len(links) == 0 {
+		return nil, nil
+	}
+	var inserted []Discovery
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		inserted = nil
+		for name, found := range links {
+			created, err := upsertBoltLinks(tx, name, found)
+			if err != nil {
+				return err
+			}
+			if created {
+				inserted = append(inserted, found.discovery(name))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+// Leases domains to a worker inside one update transaction
+type boltClaim struct {
+	tx       *bolt.Tx
+	workerId string
+	limit    int
+	lease    time.Duration
+	now      time.Time
+	claimed  []Domain
+}
+
+func (claim *boltClaim) full() bool {
+	return len(claim.claimed) >= claim.limit
+}
+
+// Take the domain unless another worker holds it or it is not due
+func (claim *boltClaim) add(id primitive.ObjectID, due func(Domain) bool) error {
+	domain, err := getBoltDomain(claim.tx, id)
+	if err != nil {
+		return err
+	}
+	if domain.LeaseExpires.After(claim.now) || due != nil && !due(domain) {
+		return nil
+	}
+	domain.ClaimedBy = claim.workerId
+	domain.LeaseExpires = claim.now.Add(claim.lease)
+	claim.claimed = append(claim.claimed, domain)
+	return nil
+}
+
+// Buckets can not be changed while a cursor walks them so the leases are
+// saved once all domains are picked
+func (claim *boltClaim) save() error {
+	for _, domain := range claim.claimed {
+		if err := putBoltDomain(claim.tx, domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Domains due for a retry come first so a long list of unchecked domains
+// can not hold them back
+func (store *BoltStore) ClaimDomainsToCheck(ctx context.Context, workerId string, limit int, lease time.Duration) ([]Domain, error) {
+	claim := &boltClaim{workerId: workerId, limit: limit, lease: lease, now: time.Now()}
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		claim.tx = tx
+		cursor := tx.Bucket(retryBucket).Cursor()
+		for key, _ := cursor.First(); key != nil && timeKeyBefore(key, claim.now) && !claim.full(); key, _ = cursor.Next() {
+			if err := claim.add(objectIdFromKey(key[8:]), nil); err != nil {
+				return err
+			}
+		}
+		cursor = tx.Bucket(uncheckedBucket).Cursor()
+		for id, _ := cursor.First(); id != nil && !claim.full(); id, _ = cursor.Next() {
+			if err := claim.add(objectIdFromKey(id), nil); err != nil {
+				return err
+			}
+		}
+		return claim.save()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claim.claimed, nil
+}
+
+// Walks the checked index from the oldest crawl up to the latest time any
+// domain can be due
+func (store *BoltStore) ClaimDomainsToRecrawl(ctx context.Context, workerId string, limit int, lease time.Duration, policy RecrawlPolicy) ([]Domain, error) {
+	claim := &boltClaim{workerId: workerId, limit: limit, lease: lease, now: time.Now()}
+	_, popularCutoff := policy.cutoffs(claim.now)
+	due := func(domain Domain) bool {
+		return policy.isDue(domain, claim.now)
+	}
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		claim.tx = tx
+		cursor := tx.Bucket(checkedBucket).Cursor()
+		for key, _ := cursor.First(); key != nil && timeKeyBefore(key, popularCutoff) && !claim.full(); key, _ = cursor.Next() {
+			if err := claim.add(objectIdFromKey(key[8:]), due); err != nil {
+				return err
+			}
+		}
+		return claim.save()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return claim.claimed, nil
+}
+
+func (store *BoltStore) RenewLeases(ctx context.Context, workerId string, ids []primitive.ObjectID, lease time.Duration) error {
+	leaseExpires := time.Now().Add(lease)
+	return store.db.Update(func(tx *bolt.Tx) error {
+		for _, id := range ids {
+			domain, err := getBoltDomain(tx, id)
+			if err == ErrNotFound || err == nil && domain.ClaimedBy != workerId {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			domain.LeaseExpires = leaseExpires
+			if err = putBoltDomain(tx, domain); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (store *BoltStore) UpdateDomain(ctx context.Context, workerId string, domain Domain) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		existing, err := getBoltDomain(tx, domain.Id)
+		if err != nil {
+			return err
+		}
+		if existing.ClaimedBy != workerId {
+			return ErrLeaseLost
+		}
+		// Links found while the domain was crawled are kept
+		domain.InDegree = existing.InDegree
+		domain.DiscoverySources = existing.DiscoverySources
+		if err = removeBoltIndexes(tx, existing); err != nil {
+			return err
+		}
+		if existing.Name != domain.Name {
+			if err = tx.Bucket(namesBucket).Delete([]byte(existing.Name)); err != nil {
+				return err
+			}
+		}
+		return putBoltDomain(tx, domain)
+	})
+}
+
+func (store *BoltStore) AddObservation(ctx context.Context, observation Observation) (primitive.ObjectID, error) {
+	if observation.Id.IsZero() {
+		observation.Id = primitive.NewObjectID()
+	}
+	data, err := bson.Marshal(observation)
+	if err != nil {
+		return observation.Id, err
+	}
+	key := append(observation.DomainId[:], observation.Id[:]...)
+	err = store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(observationsBucket).Put(key, data)
+	})
+	return observation.Id, err
+}
+
+// Observation ids grow over time so walking the domain prefix backwards gives
+// the newest first
+func (store *BoltStore) ListObservations(ctx context.Context, domainId primitive.ObjectID) ([]Observation, error) {
+	var observations []Observation
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(observationsBucket)
+		if bucket == nil { // Read only file written before observations existed
+			return nil
+		}
+		cursor := bucket.Cursor()
+		prefix := domainId[:]
+		end := append(append([]byte{}, prefix...), bytes.Repeat([]byte{0xff}, 12)...)
+		key, data := cursor.Seek(end)
+		if key == nil || !bytes.Equal(key, end) {
+			key, data = cursor.Prev()
+		}
+		for ; key != nil && bytes.HasPrefix(key, prefix); key, data = cursor.Prev() {
+			var observation Observation
+			if err := bson.Unmarshal(data, &observation); err != nil {
+				return err
+			}
+			observations = append(observations, observation)
+		}
+		return nil
+	})
+	return observations, err
+}
+
+func getBoltSite(tx *bolt.Tx, name string) (Site, error) {
+	site := Site{Name: name}
+	data := tx.Bucket(sitesBucket).Get([]byte(name))
+	if data == nil {
+		return site, nil
+	}
+	err := bson.Unmarshal(data, &site)
+	return site, err
+}
+
+func putBoltSite(tx *bolt.Tx, site Site) error {
+	data, err := bson.Marshal(site)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(sitesBucket).Put([]byte(site.Name), data)
+}
+
+func (store *BoltStore) AddSubdomain(ctx context.Context, name string, maxSubdomains int) (Site, error) {
+	var site Site
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if site, err = getBoltSite(tx, name); err != nil {
+			return err
+		}
+		site.Subdomains++
+		if shouldQuarantine(site, maxSubdomains) {
+			site.Quarantined = true
+			site.QuarantinedAt = time.Now()
+		}
+		return putBoltSite(tx, site)
+	})
+	return site, err
+}
+
+func (store *BoltStore) ListQuarantinedSites(ctx context.Context) ([]Site, error) {
+	var sites []Site
+	err := store.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(sitesBucket)
+		if bucket == nil { // Read only file written before sites existed
+			return nil
+		}
+		return bucket.ForEach(func(name []byte, data []byte) error {
+			var site Site
+			if err := bson.Unmarshal(data, &site); err != nil {
+				return err
+			}
+			if site.Quarantined {
+				sites = append(sites, site)
+			}
+			return nil
+		})
+	})
+	sort.Slice(sites, func(i, j int) bool {
+		return sites[i].Subdomains > sites[j].Subdomains
+	})
+	return sites, err
+}
+
+func (store *BoltStore) ReleaseSite(ctx context.Context, name string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		site, err := getBoltSite(tx, name)
+		if err != nil {
+			return err
+		}
+		site.Quarantined = false
+		site.QuarantinedAt = time.Time{}
+		site.Released = true
+		if err = putBoltSite(tx, site); err != nil {
+			return err
+		}
+
+		// Domains can not be changed while the cursor walks them
+		var ignored []Domain
+		err = tx.Bucket(domainsBucket).ForEach(func(id []byte, data []byte) error {
+			var domain Domain
+			if err := bson.Unmarshal(data, &domain); err != nil {
+				return err
+			}
+			if domain.RegistrableDomain == name && domain.Status == StatusIgnored {
+				ignored = append(ignored, domain)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, domain := range ignored {
+			if err = removeBoltIndexes(tx, domain); err != nil {
+				return err
+			}
+			domain.Status = StatusUnchecked
+			domain.ErrorClass = ""
+			domain.ErrorMessage = ""
+			domain.Skipped = false
+			if err = putBoltDomain(tx, domain); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Compiled form of a DomainFilter for matching decoded domains
+type boltMatcher struct {
+	filter         DomainFilter
+	name           *regexp.Regexp
+	headerValue    *regexp.Regexp
+	headerFallback *regexp.Regexp
+}
+
+func newBoltMatcher(filter DomainFilter) (*boltMatcher, error) {
+	var err error
+	matcher := &boltMatcher{filter: filter}
+	if filter.NamePattern != "" {
+		if matcher.name, err = regexp.Compile(filter.NamePattern); err != nil {
+			return nil, err
+		}
+	}
+	if filter.HeaderValuePattern != "" {
+		if matcher.headerValue, err = regexp.Compile(filter.HeaderValuePattern); err != nil {
+			return nil, err
+		}
+	}
+	if filter.HeaderFallback != "" {
+		if matcher.headerFallback, err = regexp.Compile(filter.HeaderFallback); err != nil {
+			return nil, err
+		}
+	}
+	return matcher, nil
+}
+
+func headersMatch(domain Domain, pattern *regexp.Regexp) bool {
+	for _, header := range domain.Headers {
+		for _, value := range header.AllValues() {
+			if pattern.MatchString(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Whether the domain uses the technology of the filter, judged by its
+// headers if it was crawled before fingerprinting
+func (matcher *boltMatcher) matchesTechnology(domain Domain) bool {
+	if domain.HasTechnology(matcher.filter.Technology) {
+		return true
+	}
+	return matcher.headerFallback != nil && domain.Fingerprints == "" && headersMatch(domain, matcher.headerFallback)
+}
+
+func (matcher *boltMatcher) matches(domain Domain) bool {
+	if matcher.name != nil && !matcher.name.MatchString(domain.Name) {
+		return false
+	}
+	if matcher.filter.RegistrableDomain != "" && domain.RegistrableDomain != matcher.filter.RegistrableDomain {
+		return false
+	}
+	if matcher.filter.Technology != "" && !matcher.matchesTechnology(domain) {
+		return false
+	}
+	if matcher.filter.CheckedOnly && len(domain.Headers) == 0 {
+		return false
+	}
+	if matcher.filter.StatusCode != 0 && domain.StatusCode != matcher.filter.StatusCode {
+		return false
+	}
+	if matcher.filter.Protocol != "" && domain.Protocol != matcher.filter.Protocol {
+		return false
+	}
+	if matcher.filter.TLSOnly && !domain.TLS {
+		return false
+	}
+	if matcher.filter.Status != StatusUnchecked && domain.CrawlStatus() != matcher.filter.Status {
+		return false
+	}
+	if matcher.filter.ErrorClass != "" && domain.ErrorClass != matcher.filter.ErrorClass {
+		return false
+	}
+	return matcher.headerValue == nil || headersMatch(domain, matcher.headerValue)
+}
+
+// Walk the domains matching filter, using the most selective index available,
+// until fn returns false
+func (store *BoltStore) scan(filter DomainFilter, fn func(Domain) bool) error {
+	matcher, err := newBoltMatcher(filter)
+	if err != nil {
+		return err
+	}
+	return store.db.View(func(tx *bolt.Tx) error {
+		visit := func(id primitive.ObjectID) (bool, error) {
+			domain, err := getBoltDomain(tx, id)
+			if err != nil {
+				return false, err
+			}
+			if !matcher.matches(domain) {
+				return true, nil
+			}
+			return fn(domain), nil
+		}
+
+		switch {
+		case matcher.headerValue != nil:
+			// A domain can have several matching values so remember what was visited
+			visited := make(map[primitive.ObjectID]bool)
+			// Keys are sorted by value so each distinct value is only matched once.
+			// Long values are cut short in the key so their domain is always
+			// visited, which matches the whole value.
+			var lastValue *string
+			lastMatched := false
+			cursor := tx.Bucket(headerValuesBucket).Cursor()
+			for key, _ := cursor.First(); key != nil; key, _ = cursor.Next() {
+				value, id, complete := splitHeaderValueKey(key)
+				if lastValue == nil || value != *lastValue {
+					lastValue, lastMatched = &value, !complete || matcher.headerValue.MatchString(value)
+				}
+				if !lastMatched || visited[id] {
+					continue
+				}
+				visited[id] = true
+				if more, err := visit(id); err != nil || !more {
+					return err
+				}
+			}
+		case matcher.name != nil:
+			cursor := tx.Bucket(namesBucket).Cursor()
+			for name, id := cursor.First(); name != nil; name, id = cursor.Next() {
+				if !matcher.name.Match(name) {
+					continue
+				}
+				if more, err := visit(objectIdFromKey(id)); err != nil || !more {
+					return err
+				}
+			}
+		default:
+			cursor := tx.Bucket(domainsBucket).Cursor()
+			for id, _ := cursor.First(); id != nil; id, _ = cursor.Next() {
+				if more, err := visit(objectIdFromKey(id)); err != nil || !more {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (store *BoltStore) ListDomains(ctx context.Context, filter DomainFilter, skip int, limit int) ([]Domain, error) {
+	var domains []Domain
+	err := store.scan(filter, func(domain Domain) bool {
+		if skip > 0 {
+			skip--
+			return true
+		}
+		domains = append(domains, domain)
+		return len(domains) < limit
+	})
+	return domains, err
+}
+
+func (store *BoltStore) ForEachDomainName(ctx context.Context, fn func(name string) error) error {
+	return store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(namesBucket).ForEach(func(name []byte, id []byte) error {
+			return fn(string(name))
+		})
+	})
+}
+
+func (store *BoltStore) CountDomains(ctx context.Context, filter DomainFilter) (int, error) {
+	if filter == (DomainFilter{}) {
+		count := 0
+		err := store.db.View(func(tx *bolt.Tx) error {
+			count = tx.Bucket(domainsBucket).Stats().KeyN
+			return nil
+		})
+		return count, err
+	}
+	count := 0
+	err := store.scan(filter, func(domain Domain) bool {
+		count++
+		return true
+	})
+	return count, err
+}
+
+func (store *BoltStore) CountByStatus(ctx context.Context) ([]StatusCount, error) {
+	var counts []StatusCount
+	err := store.scan(DomainFilter{}, func(domain Domain) bool {
+		counts = mergeStatusCount(counts, domain.CrawlStatus(), domain.ErrorClass, 1)
+		return true
+	})
+	sortStatusCounts(counts)
+	return counts, err
+}
+
+func (store *BoltStore) Close() {
+	store.db.Close()
+}
@@ -0,0 +1,67 @@
+package core
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func openTestBoltStore(t *testing.T) *BoltStore {
+	t.Helper()
+	store, err := NewBoltStore(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+func TestBoltStoreLongHeaderValue(t *testing.T) {
+	ctx := context.Background()
+	store := openTestBoltStore(t)
+	if _, err := store.UpsertDiscoveredDomains(ctx, []Discovery{{Name: "example.com"}}, primitive.NilObjectID); err != nil {
+		t.Fatal(err)
+	}
+	domain := claimTestDomain(t, store, "example.com")
+
+	// Longer than the 32 KiB Bolt allows for a key, with the match at the end
+	policy := "default-src 'self'; script-src " + strings.Repeat("https://cdn.example.net ", 1700) + "https://tail.example.org"
+	domain.Status = StatusOK
+	domain.Headers = []Header{{Key: "Content-Security-Policy", Value: policy}, {Key: "Server", Value: "nginx"}}
+	if err := store.UpdateDomain(ctx, "test", domain); err != nil {
+		t.Fatalf("saving a %d byte header: %v", len(policy), err)
+	}
+
+	for _, pattern := range []string{"tail\\.example\\.org$", "^default-src", "^nginx$"} {
+		count, err := store.CountDomains(ctx, DomainFilter{HeaderValuePattern: pattern})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("%s matched %d domains, want 1", pattern, count)
+		}
+	}
+	count, err := store.CountDomains(ctx, DomainFilter{HeaderValuePattern: "apache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("apache matched %d domains, want 0", count)
+	}
+
+	// The old index keys are removed when the headers change
+	domain.Headers = []Header{{Key: "Server", Value: "nginx"}}
+	if err := store.UpdateDomain(ctx, "test", domain); err != nil {
+		t.Fatal(err)
+	}
+	count, err = store.CountDomains(ctx, DomainFilter{HeaderValuePattern: "tail"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("removed header still matched %d domains", count)
+	}
+}
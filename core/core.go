@@ -3,19 +3,259 @@ package core
 import (
 	"time"
 
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Value holds the first value of the header. Headers that were repeated in
+// the response, like Set-Cookie, also have every value in Values.
 type Header struct {
-	Key   string
-	Value string
+	Key    string
+	Value  string
+	Values []string `bson:",omitempty"`
 }
 
+func (header Header) AllValues() []string {
+	if len(header.Values) > 0 {
+		return header.Values
+	}
+	return []string{header.Value}
+}
+
+// Headers always holds the most recent crawl. Earlier crawls are kept as
+// Observations and LatestObservation points at the one matching Headers.
 type Domain struct {
-	Id           bson.ObjectId `bson:"_id,omitempty"`
-	Name         string
-	ParentDomain bson.ObjectId `bson:",omitempty"`
-	Skipped      bool          `bson:",omitempty"`
-	LastChecked  time.Time     `bson:",omitempty"`
-	Headers      []Header      `bson:",omitempty"`
+	Id                primitive.ObjectID `bson:"_id,omitempty"`
+	Name              string
+	RegistrableDomain string             `bson:",omitempty"` // e.g. example.co.uk for www.example.co.uk
+	ParentDomain      primitive.ObjectID `bson:",omitempty"`
+	Skipped           bool               `bson:",omitempty"` // Only set by older versions, see CrawlStatus
+	Status            CrawlStatus        `bson:",omitempty"`
+	ErrorClass        string             `bson:",omitempty"`
+	ErrorMessage      string             `bson:",omitempty"`
+	Attempts          int                `bson:",omitempty"` // Failed crawls in a row
+	NextAttempt       time.Time          `bson:",omitempty"` // When a domain with StatusRetry is due again
+	ClaimedBy         string             `bson:",omitempty"` // Worker crawling the domain right now
+	LeaseExpires      time.Time          `bson:",omitempty"` // Other workers may claim the domain after this
+	LastChecked       time.Time          `bson:",omitempty"`
+	Headers           []Header           `bson:",omitempty"`
+	LatestObservation primitive.ObjectID `bson:",omitempty"`
+	DiscoverySource   string             `bson:",omitempty"` // Where the first parent referenced this domain
+	DiscoverySources  []string           `bson:",omitempty"` // Every kind of element links to this domain were found in
+	Port              int                `bson:",omitempty"` // Non-default port of the first link to this domain
+	InDegree          int                `bson:",omitempty"` // How often crawls of other domains found this one, counting recrawls
+	Robots            *RobotsDecision    `bson:",omitempty"`
+	Technologies      []Technology       `bson:",omitempty"` // Detected by the Fingerprinter on the last successful crawl
+	Fingerprints      string             `bson:",omitempty"` // Version of the rules that detected Technologies
+	ResponseInfo      `bson:",inline"`
+}
+
+// Outcome of the last crawl of a domain
+type CrawlStatus string
+
+const (
+	StatusUnchecked CrawlStatus = ""
+	StatusOK        CrawlStatus = "ok"
+	StatusIgnored   CrawlStatus = "ignored"
+	StatusFailed    CrawlStatus = "failed"  // ErrorClass says why
+	StatusRetry     CrawlStatus = "retry"   // Failed with a transient error, tried again after NextAttempt
+	StatusBlocked   CrawlStatus = "blocked" // robots.txt does not allow crawling the domain
+	StatusSkipped   CrawlStatus = "skipped" // Failed or ignored by an older version, reason unknown
+)
+
+// Why a crawl failed
+const (
+	ErrorClassBadRequest        = "bad_request"
+	ErrorClassDNS               = "dns"
+	ErrorClassTimeout           = "timeout"
+	ErrorClassConnectionRefused = "connection_refused"
+	ErrorClassConnectionReset   = "connection_reset"
+	ErrorClassTooManyOpenFiles  = "too_many_open_files"
+	ErrorClassTLS               = "tls"
+	ErrorClassTooManyRedirects  = "too_many_redirects"
+	ErrorClassOther             = "other"
+)
+
+// The status of the domain, also for documents written before Status existed
+// which only have Skipped or Headers set
+func (domain Domain) CrawlStatus() CrawlStatus {
+	return effectiveStatus(domain.Status, domain.Skipped, len(domain.Headers) > 0)
+}
+
+func effectiveStatus(status CrawlStatus, skipped bool, hasHeaders bool) CrawlStatus {
+	switch {
+	case status != StatusUnchecked:
+		return status
+	case skipped:
+		return StatusSkipped
+	case hasHeaders:
+		return StatusOK
+	}
+	return StatusUnchecked
+}
+
+// Whether the last crawl detected the named technology
+func (domain Domain) HasTechnology(name string) bool {
+	for _, technology := range domain.Technologies {
+		if technology.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// What robots.txt said about crawling the root page of a domain
+type RobotsDecision struct {
+	Result     string
+	CrawlDelay time.Duration `bson:",omitempty"` // Requested for our user agent
+	Checked    time.Time
+}
+
+// Possible RobotsDecision results
+const (
+	RobotsAllowed     = "allowed"
+	RobotsDisallowed  = "disallowed"
+	RobotsMissing     = "missing"     // 4xx response, everything is allowed
+	RobotsUnreachable = "unreachable" // 5xx response, nothing is allowed
+	RobotsError       = "error"       // Request failed, left to the crawl of the page
+)
+
+// Subdomain counts for a registrable domain such as example.co.uk, used to
+// spot sites with endless generated subdomains
+type Site struct {
+	Name          string `bson:"_id"`
+	Subdomains    int
+	Quarantined   bool      `bson:",omitempty"` // New subdomains are not added or crawled
+	QuarantinedAt time.Time `bson:",omitempty"`
+	Released      bool      `bson:",omitempty"` // Reviewed and never quarantined again
+}
+
+// Where in a crawled response a new domain name was found
+const (
+	SourceSeed        = "seed"
+	SourceAnchor      = "a"
+	SourceLocation    = "location" // Location header, including redirects that were followed
+	SourceCertificate = "certificate"
+	SourceCSP         = "csp"
+	SourceCORS        = "cors" // Access-Control-Allow-Origin
+	SourceLinkHeader  = "link-header"
+
+	// Elements of an HTML body. Anchors, forms, meta refreshes and base URLs
+	// are navigation, the rest are resources the page loads.
+	SourceBase        = "base"
+	SourceForm        = "form"
+	SourceMetaRefresh = "meta-refresh"
+	SourceLink        = "link"
+	SourceScript      = "script"
+	SourceImage       = "img"
+	SourceIframe      = "iframe"
+	SourceSrcset      = "srcset"
+	SourceJSONLD      = "json-ld"
+)
+
+// Whether the source is a link a visitor would follow rather than a resource
+// the page depends on
+func IsNavigationSource(source string) bool {
+	switch source {
+	case SourceAnchor, SourceBase, SourceForm, SourceMetaRefresh:
+		return true
+	}
+	return false
+}
+
+// A domain name found while crawling another domain
+type Discovery struct {
+	Name   string
+	Port   int // Only set when the link named a port other than the scheme default
+	Source string
+}
+
+// Links found to an existing domain that were not saved yet
+type Links struct {
+	Count   int
+	Sources []string // Discovery sources, each listed once
+
+	// Where the first link was found, used if the domain has to be created
+	Parent primitive.ObjectID
+	Port   int
+}
+
+// Count a link and remember where it was found
+func (links *Links) Add(source string) {
+	links.Count++
+	links.AddSource(source)
+}
+
+func (links *Links) AddSource(source string) {
+	if source == "" {
+		return
+	}
+	for _, known := range links.Sources {
+		if known == source {
+			return
+		}
+	}
+	links.Sources = append(links.Sources, source)
+}
+
+// The discovery of the name by the first link
+func (links Links) discovery(name string) Discovery {
+	discovery := Discovery{Name: name, Port: links.Port}
+	if len(links.Sources) > 0 {
+		discovery.Source = links.Sources[0]
+	}
+	return discovery
+}
+
+// Links found by a crawl of parentId, which count towards the InDegree
+func discoveryLinks(discovery Discovery, parentId primitive.ObjectID) Links {
+	links := Links{Parent: parentId, Port: discovery.Port}
+	if !parentId.IsZero() {
+		links.Count = 1
+	}
+	links.AddSource(discovery.Source)
+	return links
+}
+
+// Details about the HTTP response of a crawl apart from the headers
+type ResponseInfo struct {
+	StatusCode      int           `bson:",omitempty"`
+	Protocol        string        `bson:",omitempty"` // e.g. HTTP/1.1 or HTTP/2.0
+	TLS             bool          `bson:",omitempty"`
+	FinalURL        string        `bson:",omitempty"` // After following redirects
+	TimeToFirstByte time.Duration `bson:",omitempty"`
+	Duration        time.Duration `bson:",omitempty"` // Until the body was read
+	RedirectChain   []RedirectHop `bson:",omitempty"`
+	TLSInfo         *TLSInfo      `bson:",omitempty"`
+}
+
+// The negotiated TLS connection and the certificate presented by the server
+type TLSInfo struct {
+	Version     string // e.g. TLS 1.3
+	CipherSuite string
+	ALPN        string    `bson:",omitempty"`
+	Subject     string    `bson:",omitempty"`
+	Issuer      string    `bson:",omitempty"`
+	NotBefore   time.Time `bson:",omitempty"`
+	NotAfter    time.Time `bson:",omitempty"`
+	SANs        []string  `bson:",omitempty"` // DNS names and IP addresses
+	Verified    bool
+	VerifyError string `bson:",omitempty"`
+}
+
+// A redirect response that was followed on the way to the final URL
+type RedirectHop struct {
+	URL        string
+	StatusCode int
+	Location   string
+	Headers    []Header `bson:",omitempty"`
+}
+
+// Snapshot of a domain taken each time it is crawled
+type Observation struct {
+	Id           primitive.ObjectID `bson:"_id,omitempty"`
+	DomainId     primitive.ObjectID
+	Time         time.Time
+	IP           string   `bson:",omitempty"`
+	Headers      []Header `bson:",omitempty"`
+	ResponseInfo `bson:",inline"`
 }
@@ -0,0 +1,589 @@
+package core
+
+import (
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Only the start of large bodies is searched
+const maxFingerprintBody = 512 * 1024
+
+// Rules used when the worker is not given a file
+//
+//go:embed technologies.json
+var defaultFingerprints []byte
+
+// A technology detected on a domain
+type Technology struct {
+	Name       string
+	Version    string   `bson:",omitempty"`
+	Confidence int      // Percent
+	Categories []string `bson:",omitempty"`
+}
+
+// One pattern of a rule, e.g. ^Drupal(?:\s([\d.]+))?\;version:\1\;confidence:50
+type fingerprintPattern struct {
+	regex      *regexp.Regexp // nil when only the presence of a header, cookie or meta tag counts
+	version    string         // Template with \1 for capture groups, or \1?found:missing
+	confidence int
+}
+
+var (
+	versionTernary   = regexp.MustCompile(`^\\(\d+)\?([^:]*):(.*)$`)
+	versionReference = regexp.MustCompile(`\\(\d+)`)
+)
+
+func parseFingerprintPattern(value string) (*fingerprintPattern, error) {
+	parts := strings.Split(value, `\;`)
+	pattern := &fingerprintPattern{confidence: 100}
+	for _, tag := range parts[1:] {
+		key, tagValue, _ := strings.Cut(tag, ":")
+		switch key {
+		case "version":
+			pattern.version = tagValue
+		case "confidence":
+			confidence, err := strconv.Atoi(tagValue)
+			if err != nil {
+				return nil, fmt.Errorf("bad confidence %q", tagValue)
+			}
+			pattern.confidence = confidence
+		}
+	}
+	if parts[0] != "" {
+		// Rules are written for JavaScript and match without case
+		regex, err := regexp.Compile("(?i)" + parts[0])
+		if err != nil {
+			return nil, err
+		}
+		pattern.regex = regex
+	}
+	return pattern, nil
+}
+
+// Whether the pattern matches value and the version it reveals, if any
+func (pattern *fingerprintPattern) match(value string) (bool, string) {
+	if pattern.regex == nil {
+		return true, ""
+	}
+	groups := pattern.regex.FindStringSubmatch(value)
+	if groups == nil {
+		return false, ""
+	}
+	if pattern.version == "" {
+		return true, ""
+	}
+	group := func(reference string) string {
+		n, _ := strconv.Atoi(reference)
+		if n < len(groups) {
+			return groups[n]
+		}
+		return ""
+	}
+	version := pattern.version
+	if ternary := versionTernary.FindStringSubmatch(version); ternary != nil {
+		version = ternary[3]
+		if group(ternary[1]) != "" {
+			version = ternary[2]
+		}
+	}
+	version = versionReference.ReplaceAllStringFunc(version, func(reference string) string {
+		return group(reference[1:])
+	})
+	return true, strings.TrimSpace(version)
+}
+
+// A pattern that has to match a named value like a header or cookie
+type namedPattern struct {
+	name    string
+	nameRe  *regexp.Regexp // Cookie names starting with ^ are regular expressions
+	pattern *fingerprintPattern
+}
+
+func (named namedPattern) matchesName(name string) bool {
+	if named.nameRe != nil {
+		return named.nameRe.MatchString(name)
+	}
+	return strings.EqualFold(named.name, name)
+}
+
+type impliedTechnology struct {
+	name       string
+	confidence int
+}
+
+type technologyRule struct {
+	name        string
+	categoryIds []int
+	categories  []string
+	headers     []namedPattern
+	cookies     []namedPattern
+	meta        []namedPattern
+	scriptSrc   []*fingerprintPattern
+	body        []*fingerprintPattern
+	implies     []impliedTechnology
+	excludes    []string
+}
+
+// A set of rules compatible with the Wappalyzer technology format. Patterns
+// Go can not compile, like lookaheads, are skipped.
+type Fingerprinter struct {
+	Version string // Of the rules, stored with every result
+	Skipped int    // Patterns that could not be compiled
+
+	rules      []*technologyRule
+	byName     map[string]*technologyRule
+	categories map[int]string
+}
+
+// Number of technologies with rules
+func (fingerprinter *Fingerprinter) Count() int {
+	return len(fingerprinter.rules)
+}
+
+// The rules that ship with WebGenome
+func DefaultFingerprinter() (*Fingerprinter, error) {
+	return ParseFingerprints(defaultFingerprints)
+}
+
+// Load rules from a JSON file, or from every .json file of a directory as
+// laid out by Wappalyzer where categories.json in the directory or its parent
+// names the categories
+func LoadFingerprints(path string) (*Fingerprinter, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return ParseFingerprints(data)
+	}
+
+	files, err := filepath.Glob(filepath.Join(path, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	// Wappalyzer keeps the categories next to the technologies directory
+	categories := filepath.Join(path, "categories.json")
+	if _, err := os.Stat(categories); os.IsNotExist(err) {
+		categories = filepath.Join(filepath.Dir(filepath.Clean(path)), "categories.json")
+		if _, err := os.Stat(categories); err == nil {
+			files = append(files, categories)
+		}
+	}
+	fingerprinter := newFingerprinter()
+	checksum := sha1.New()
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		checksum.Write(data)
+		if file == categories {
+			err = fingerprinter.addCategories(data)
+		} else {
+			err = fingerprinter.addFile(data)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	if fingerprinter.Version == "" {
+		fingerprinter.Version = hex.EncodeToString(checksum.Sum(nil))[:12]
+	}
+	fingerprinter.resolveCategories()
+	return fingerprinter, nil
+}
+
+// Parse a single rules file. It is either an object with version,
+// technologies and categories or just the technologies keyed by name.
+func ParseFingerprints(data []byte) (*Fingerprinter, error) {
+	fingerprinter := newFingerprinter()
+	if err := fingerprinter.addFile(data); err != nil {
+		return nil, err
+	}
+	if fingerprinter.Version == "" {
+		checksum := sha1.Sum(data)
+		fingerprinter.Version = hex.EncodeToString(checksum[:])[:12]
+	}
+	fingerprinter.resolveCategories()
+	return fingerprinter, nil
+}
+
+func newFingerprinter() *Fingerprinter {
+	return &Fingerprinter{byName: make(map[string]*technologyRule), categories: make(map[int]string)}
+}
+
+func (fingerprinter *Fingerprinter) addFile(data []byte) error {
+	var file struct {
+		Version      string                     `json:"version"`
+		Technologies map[string]json.RawMessage `json:"technologies"`
+		Categories   json.RawMessage            `json:"categories"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	technologies := file.Technologies
+	if technologies == nil {
+		if err := json.Unmarshal(data, &technologies); err != nil {
+			return err
+		}
+	} else {
+		if file.Version != "" {
+			fingerprinter.Version = file.Version
+		}
+		if len(file.Categories) > 0 {
+			if err := fingerprinter.addCategories(file.Categories); err != nil {
+				return err
+			}
+		}
+	}
+
+	names := make([]string, 0, len(technologies))
+	for name := range technologies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rule, err := fingerprinter.parseRule(name, technologies[name])
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		// Later files replace the rules of a technology
+		if previous, exists := fingerprinter.byName[name]; exists {
+			for i := range fingerprinter.rules {
+				if fingerprinter.rules[i] == previous {
+					fingerprinter.rules[i] = rule
+				}
+			}
+		} else {
+			fingerprinter.rules = append(fingerprinter.rules, rule)
+		}
+		fingerprinter.byName[name] = rule
+	}
+	return nil
+}
+
+// Categories keyed by their number, e.g. {"1": {"name": "CMS"}}
+func (fingerprinter *Fingerprinter) addCategories(data []byte) error {
+	var categories map[string]struct {
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(data, &categories); err != nil {
+		return err
+	}
+	for id, category := range categories {
+		number, err := strconv.Atoi(id)
+		if err != nil {
+			return fmt.Errorf("bad category id %q", id)
+		}
+		fingerprinter.categories[number] = category.Name
+	}
+	return nil
+}
+
+func (fingerprinter *Fingerprinter) resolveCategories() {
+	for _, rule := range fingerprinter.rules {
+		rule.categories = nil
+		for _, id := range rule.categoryIds {
+			if name, found := fingerprinter.categories[id]; found {
+				rule.categories = append(rule.categories, name)
+			}
+		}
+	}
+}
+
+// A string or a list of strings
+func fingerprintStrings(data json.RawMessage) ([]string, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	var list []string
+	if data[0] == '[' {
+		err := json.Unmarshal(data, &list)
+		return list, err
+	}
+	var value string
+	err := json.Unmarshal(data, &value)
+	return []string{value}, err
+}
+
+func (fingerprinter *Fingerprinter) patterns(data json.RawMessage) ([]*fingerprintPattern, error) {
+	values, err := fingerprintStrings(data)
+	if err != nil {
+		return nil, err
+	}
+	var patterns []*fingerprintPattern
+	for _, value := range values {
+		pattern, err := parseFingerprintPattern(value)
+		if err != nil {
+			fingerprinter.Skipped++
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func (fingerprinter *Fingerprinter) namedPatterns(data map[string]json.RawMessage, regexNames bool) ([]namedPattern, error) {
+	var named []namedPattern
+	for name, value := range data {
+		patterns, err := fingerprinter.patterns(value)
+		if err != nil {
+			return nil, err
+		}
+		var nameRe *regexp.Regexp
+		if regexNames && strings.HasPrefix(name, "^") {
+			if nameRe, err = regexp.Compile("(?i)" + name); err != nil {
+				fingerprinter.Skipped++
+				continue
+			}
+		}
+		for _, pattern := range patterns {
+			named = append(named, namedPattern{name: name, nameRe: nameRe, pattern: pattern})
+		}
+	}
+	return named, nil
+}
+
+func (fingerprinter *Fingerprinter) parseRule(name string, data json.RawMessage) (*technologyRule, error) {
+	var raw struct {
+		Cats      []int                      `json:"cats"`
+		Headers   map[string]json.RawMessage `json:"headers"`
+		Cookies   map[string]json.RawMessage `json:"cookies"`
+		Meta      map[string]json.RawMessage `json:"meta"`
+		ScriptSrc json.RawMessage            `json:"scriptSrc"`
+		Script    json.RawMessage            `json:"script"` // Older name of scriptSrc
+		HTML      json.RawMessage            `json:"html"`
+		Implies   json.RawMessage            `json:"implies"`
+		Excludes  json.RawMessage            `json:"excludes"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+
+	rule := &technologyRule{name: name, categoryIds: raw.Cats}
+	var err error
+	if rule.headers, err = fingerprinter.namedPatterns(raw.Headers, false); err != nil {
+		return nil, err
+	}
+	if rule.cookies, err = fingerprinter.namedPatterns(raw.Cookies, true); err != nil {
+		return nil, err
+	}
+	if rule.meta, err = fingerprinter.namedPatterns(raw.Meta, false); err != nil {
+		return nil, err
+	}
+	for _, scripts := range []json.RawMessage{raw.ScriptSrc, raw.Script} {
+		patterns, err := fingerprinter.patterns(scripts)
+		if err != nil {
+			return nil, err
+		}
+		rule.scriptSrc = append(rule.scriptSrc, patterns...)
+	}
+	if rule.body, err = fingerprinter.patterns(raw.HTML); err != nil {
+		return nil, err
+	}
+
+	implies, err := fingerprintStrings(raw.Implies)
+	if err != nil {
+		return nil, err
+	}
+	for _, implied := range implies {
+		// Implied names may carry a confidence like patterns do
+		parts := strings.Split(implied, `\;`)
+		technology := impliedTechnology{name: parts[0], confidence: 100}
+		for _, tag := range parts[1:] {
+			if value, found := strings.CutPrefix(tag, "confidence:"); found {
+				technology.confidence, _ = strconv.Atoi(value)
+			}
+		}
+		rule.implies = append(rule.implies, technology)
+	}
+	if rule.excludes, err = fingerprintStrings(raw.Excludes); err != nil {
+		return nil, err
+	}
+	return rule, nil
+}
+
+// What a crawl saw of a page, in the form the rules match against
+type fingerprintPage struct {
+	headers   map[string][]string // Lower case names
+	cookies   map[string][]string
+	meta      map[string][]string // Lower case names
+	scriptSrc []string
+	body      string
+}
+
+func newFingerprintPage(headers []Header, body []byte) *fingerprintPage {
+	page := &fingerprintPage{
+		headers: make(map[string][]string),
+		cookies: make(map[string][]string),
+		meta:    make(map[string][]string),
+	}
+	for _, header := range headers {
+		key := strings.ToLower(header.Key)
+		page.headers[key] = append(page.headers[key], header.AllValues()...)
+		if key != "set-cookie" {
+			continue
+		}
+		for _, cookie := range header.AllValues() {
+			pair, _, _ := strings.Cut(cookie, ";")
+			name, value, _ := strings.Cut(pair, "=")
+			name = strings.TrimSpace(name)
+			page.cookies[name] = append(page.cookies[name], strings.TrimSpace(value))
+		}
+	}
+
+	if len(body) > maxFingerprintBody {
+		body = body[:maxFingerprintBody]
+	}
+	page.body = string(body)
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return page
+	}
+	doc.Find("meta[content]").Each(func(i int, s *goquery.Selection) {
+		name, exists := s.Attr("name")
+		if !exists {
+			name, exists = s.Attr("property")
+		}
+		if !exists {
+			return
+		}
+		content, _ := s.Attr("content")
+		name = strings.ToLower(name)
+		page.meta[name] = append(page.meta[name], content)
+	})
+	doc.Find("script[src]").Each(func(i int, s *goquery.Selection) {
+		src, _ := s.Attr("src")
+		page.scriptSrc = append(page.scriptSrc, src)
+	})
+	return page
+}
+
+// Add the confidence and version of a matching pattern to what was found
+func detected(found map[string]*Technology, rule *technologyRule, pattern *fingerprintPattern, version string) {
+	technology := found[rule.name]
+	if technology == nil {
+		technology = &Technology{Name: rule.name, Categories: rule.categories}
+		found[rule.name] = technology
+	}
+	technology.Confidence += pattern.confidence
+	if technology.Confidence > 100 {
+		technology.Confidence = 100
+	}
+	// The longest version is the most precise, e.g. 7.4.3 over 7
+	if len(version) > len(technology.Version) {
+		technology.Version = version
+	}
+}
+
+func matchNamed(found map[string]*Technology, rule *technologyRule, patterns []namedPattern, values map[string][]string) {
+	for _, named := range patterns {
+		for name, nameValues := range values {
+			if !named.matchesName(name) {
+				continue
+			}
+			for _, value := range nameValues {
+				if matched, version := named.pattern.match(value); matched {
+					detected(found, rule, named.pattern, version)
+				}
+			}
+		}
+	}
+}
+
+func matchAll(found map[string]*Technology, rule *technologyRule, patterns []*fingerprintPattern, values []string) {
+	for _, pattern := range patterns {
+		for _, value := range values {
+			if matched, version := pattern.match(value); matched {
+				detected(found, rule, pattern, version)
+				break
+			}
+		}
+	}
+}
+
+// Detect the technologies of a crawled page from its headers and body.
+// Results are sorted by name.
+func (fingerprinter *Fingerprinter) Fingerprint(headers []Header, body []byte) []Technology {
+	page := newFingerprintPage(headers, body)
+	found := make(map[string]*Technology)
+	for _, rule := range fingerprinter.rules {
+		matchNamed(found, rule, rule.headers, page.headers)
+		matchNamed(found, rule, rule.cookies, page.cookies)
+		matchNamed(found, rule, rule.meta, page.meta)
+		matchAll(found, rule, rule.scriptSrc, page.scriptSrc)
+		matchAll(found, rule, rule.body, []string{page.body})
+	}
+
+	// Implied technologies are no more certain than what implied them.
+	// Following the implications breadth first ends on cycles.
+	queue := make([]string, 0, len(found))
+	for name := range found {
+		queue = append(queue, name)
+	}
+	sort.Strings(queue)
+	for len(queue) > 0 {
+		technology := found[queue[0]]
+		queue = queue[1:]
+		rule := fingerprinter.byName[technology.Name]
+		if rule == nil {
+			continue
+		}
+		for _, implied := range rule.implies {
+			confidence := implied.confidence
+			if technology.Confidence < confidence {
+				confidence = technology.Confidence
+			}
+			existing := found[implied.name]
+			if existing != nil && existing.Confidence >= confidence {
+				continue
+			}
+			if existing == nil {
+				existing = &Technology{Name: implied.name}
+				if impliedRule := fingerprinter.byName[implied.name]; impliedRule != nil {
+					existing.Categories = impliedRule.categories
+				}
+				found[implied.name] = existing
+			}
+			existing.Confidence = confidence
+			queue = append(queue, implied.name)
+		}
+	}
+
+	excluded := make(map[string]bool)
+	for name := range found {
+		if rule := fingerprinter.byName[name]; rule != nil {
+			for _, exclude := range rule.excludes {
+				excluded[exclude] = true
+			}
+		}
+	}
+
+	technologies := make([]Technology, 0, len(found))
+	for name, technology := range found {
+		if !excluded[name] && technology.Confidence > 0 {
+			technologies = append(technologies, *technology)
+		}
+	}
+	sort.Slice(technologies, func(i, j int) bool {
+		return technologies[i].Name < technologies[j].Name
+	})
+	return technologies
+}
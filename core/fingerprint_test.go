@@ -0,0 +1,194 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testFingerprints = `{
+	"version": "test",
+	"categories": {"1": {"name": "CMS"}, "22": {"name": "Web servers"}},
+	"technologies": {
+		"Nginx": {"cats": [22], "headers": {"Server": "nginx(?:/([\\d.]+))?\\;version:\\1"}},
+		"PHP": {"headers": {"X-Powered-By": "PHP(?:/([\\d.]+))?\\;version:\\1"}, "cookies": {"PHPSESSID": ""}},
+		"Drupal": {
+			"cats": [1],
+			"headers": {"X-Generator": "^Drupal(?:\\s([\\d.]+))?\\;version:\\1\\;confidence:50"},
+			"meta": {"generator": "^Drupal(?:\\s([\\d.]+))?\\;version:\\1\\;confidence:50"},
+			"implies": "PHP"
+		},
+		"Beta": {"headers": {"X-Release": "(beta)?\\;version:\\1?preview:stable"}},
+		"Laravel": {"cookies": {"^laravel_": ""}, "implies": "PHP\\;confidence:50"},
+		"jQuery": {"scriptSrc": "jquery[.-]([\\d.]+)(?:\\.min)?\\.js\\;version:\\1"},
+		"Guess": {"html": ["<div id=\"a\"\\;confidence:60", "<div id=\"b\"\\;confidence:70"]},
+		"Alpha": {"headers": {"X-Alpha": ""}, "implies": "Omega"},
+		"Omega": {"implies": "Alpha"},
+		"Static": {"headers": {"X-Static": ""}, "excludes": "PHP"},
+		"Lookahead": {"html": "foo(?!bar)"}
+	}
+}`
+
+func TestFingerprint(t *testing.T) {
+	fingerprinter, err := ParseFingerprints([]byte(testFingerprints))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprinter.Version != "test" || fingerprinter.Count() != 11 || fingerprinter.Skipped != 1 {
+		t.Fatalf("parsed version %s with %d technologies and %d skipped patterns", fingerprinter.Version, fingerprinter.Count(), fingerprinter.Skipped)
+	}
+
+	tests := []struct {
+		name    string
+		headers []Header
+		body    string
+		want    []Technology
+	}{
+		{
+			name:    "version capture",
+			headers: []Header{{Key: "server", Value: "nginx/1.25.3"}},
+			want:    []Technology{{Name: "Nginx", Version: "1.25.3", Confidence: 100, Categories: []string{"Web servers"}}},
+		},
+		{
+			name:    "optional version",
+			headers: []Header{{Key: "Server", Value: "nginx"}},
+			want:    []Technology{{Name: "Nginx", Confidence: 100, Categories: []string{"Web servers"}}},
+		},
+		{
+			name:    "ternary with the group",
+			headers: []Header{{Key: "X-Release", Value: "beta"}},
+			want:    []Technology{{Name: "Beta", Version: "preview", Confidence: 100}},
+		},
+		{
+			name:    "ternary without the group",
+			headers: []Header{{Key: "X-Release", Value: "1"}},
+			want:    []Technology{{Name: "Beta", Version: "stable", Confidence: 100}},
+		},
+		{
+			name:    "confidence of one pattern",
+			headers: []Header{{Key: "X-Generator", Value: "Drupal 10"}},
+			want: []Technology{
+				{Name: "Drupal", Version: "10", Confidence: 50, Categories: []string{"CMS"}},
+				{Name: "PHP", Confidence: 50},
+			},
+		},
+		{
+			name:    "confidence summed",
+			headers: []Header{{Key: "X-Generator", Value: "Drupal"}},
+			body:    `<html><head><meta name="Generator" content="Drupal 10.1"></head></html>`,
+			want: []Technology{
+				{Name: "Drupal", Version: "10.1", Confidence: 100, Categories: []string{"CMS"}},
+				{Name: "PHP", Confidence: 100},
+			},
+		},
+		{
+			name: "confidence capped at 100",
+			body: `<div id="a"></div><div id="b"></div>`,
+			want: []Technology{{Name: "Guess", Confidence: 100}},
+		},
+		{
+			name: "body",
+			body: `<div id="a"></div>`,
+			want: []Technology{{Name: "Guess", Confidence: 60}},
+		},
+		{
+			name: "implies with confidence",
+			headers: []Header{{Key: "Set-Cookie", Values: []string{
+				"laravel_session=abc; path=/; HttpOnly",
+				"XSRF-TOKEN=def; path=/",
+			}}},
+			want: []Technology{{Name: "Laravel", Confidence: 100}, {Name: "PHP", Confidence: 50}},
+		},
+		{
+			name:    "implies higher confidence than found",
+			headers: []Header{{Key: "X-Powered-By", Value: "PHP/8.2.1"}, {Key: "Set-Cookie", Value: "laravel_session=abc"}},
+			want:    []Technology{{Name: "Laravel", Confidence: 100}, {Name: "PHP", Version: "8.2.1", Confidence: 100}},
+		},
+		{
+			name:    "implies cycle",
+			headers: []Header{{Key: "X-Alpha", Value: "1"}},
+			want:    []Technology{{Name: "Alpha", Confidence: 100}, {Name: "Omega", Confidence: 100}},
+		},
+		{
+			name:    "cookie name",
+			headers: []Header{{Key: "Set-Cookie", Value: "PHPSESSID=123; path=/"}},
+			want:    []Technology{{Name: "PHP", Confidence: 100}},
+		},
+		{
+			name:    "cookie name regex does not match",
+			headers: []Header{{Key: "Set-Cookie", Value: "my_laravel_session=abc"}},
+			want:    []Technology{},
+		},
+		{
+			name:    "excludes",
+			headers: []Header{{Key: "X-Powered-By", Value: "PHP/8.2.1"}, {Key: "X-Static", Value: "1"}},
+			want:    []Technology{{Name: "Static", Confidence: 100}},
+		},
+		{
+			name: "script src",
+			body: `<html><script src="/js/jquery-3.7.1.min.js"></script></html>`,
+			want: []Technology{{Name: "jQuery", Version: "3.7.1", Confidence: 100}},
+		},
+		{
+			name: "script text is not a script src",
+			body: `<html><script>load("jquery-3.7.1.min.js")</script></html>`,
+			want: []Technology{},
+		},
+		{
+			name:    "nothing",
+			headers: []Header{{Key: "Server", Value: "Apache"}},
+			body:    `<html></html>`,
+			want:    []Technology{},
+		},
+	}
+	for _, test := range tests {
+		got := fingerprinter.Fingerprint(test.headers, []byte(test.body))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLoadFingerprintsDirectory(t *testing.T) {
+	writeFile := func(path, data string) {
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	headers := []Header{{Key: "Server", Value: "nginx/1.25.3"}, {Key: "X-Powered-By", Value: "PHP/8.2.1"}}
+	want := []Technology{
+		{Name: "Nginx", Version: "1.25.3", Confidence: 100, Categories: []string{"Web servers"}},
+		{Name: "PHP", Version: "8.2.1", Confidence: 100, Categories: []string{"Programming languages"}},
+	}
+
+	for _, test := range []struct {
+		name       string
+		categories string // Where categories.json is, relative to the technologies
+	}{
+		{"categories in the directory", "."},
+		{"categories in the parent", ".."},
+	} {
+		dir := filepath.Join(t.TempDir(), "technologies")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(filepath.Join(dir, "n.json"), `{"Nginx": {"cats": [22], "headers": {"Server": "nginx(?:/([\\d.]+))?\\;version:\\1"}}}`)
+		writeFile(filepath.Join(dir, "p.json"), `{"PHP": {"cats": [27], "headers": {"X-Powered-By": "PHP(?:/([\\d.]+))?\\;version:\\1"}}}`)
+		writeFile(filepath.Join(dir, test.categories, "categories.json"), `{"22": {"name": "Web servers"}, "27": {"name": "Programming languages"}}`)
+
+		fingerprinter, err := LoadFingerprints(dir)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if fingerprinter.Count() != 2 {
+			t.Errorf("%s: loaded %d technologies, want 2", test.name, fingerprinter.Count())
+		}
+		if len(fingerprinter.Version) != 12 {
+			t.Errorf("%s: version %q is not a checksum of the files", test.name, fingerprinter.Version)
+		}
+		if got := fingerprinter.Fingerprint(headers, nil); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, want)
+		}
+	}
+}
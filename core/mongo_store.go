@@ -0,0 +1,632 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// How many documents are inspected when checking existing data
+const compatibilitySampleSize = 1000
+
+// DomainStore backed by a MongoDB collection. Observations and sites go in
+// collections named after the first with _observations and _sites suffixes.
+type MongoStore struct {
+	client       *mongo.Client
+	collection   *mongo.Collection
+	observations *mongo.Collection
+	sites        *mongo.Collection
+}
+
+// Host can be a plain host[:port] as used with the old mgo driver or a full
+// mongodb:// connection string
+func NewMongoStore(ctx context.Context, host string, database string, collection string, poolSize uint64) (*MongoStore, error) {
+	uri := host
+	if !strings.HasPrefix(uri, "mongodb://") && !strings.HasPrefix(uri, "mongodb+srv://") {
+		uri = "mongodb://" + uri
+	}
+	clientOptions := options.Client().ApplyURI(uri)
+	if poolSize > 0 {
+		clientOptions.SetMaxPoolSize(poolSize)
+	}
+
+	client, err := mongo.Connect(ctx, clientOptions)
+	if err != nil {
+		return nil, err
+	}
+	if err = client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+
+	store := &MongoStore{
+		client:       client,
+		collection:   client.Database(database).Collection(collection),
+		observations: client.Database(database).Collection(collection + "_observations"),
+		sites:        client.Database(database).Collection(collection + "_sites"),
+	}
+	if err = store.CheckCompatibility(ctx); err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	_, err = store.observations.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "domainid", Value: 1}, {Key: "time", Value: -1}},
+	})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	// Discovered domains are upserted by name, which has to be unique
+	_, err = store.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "name", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("creating unique index on name, drop any old non-unique name index and duplicate names first: %v", err)
+	}
+	// Recrawling walks the domains by age, sites group them and the website
+	// lists them by technology
+	_, err = store.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "lastchecked", Value: 1}}},
+		{Keys: bson.D{{Key: "registrabledomain", Value: 1}}},
+		{Keys: bson.D{{Key: "technologies.name", Value: 1}}},
+	})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, err
+	}
+	return store, nil
+}
+
+// Verify that a sample of the existing documents stores _id and parentdomain
+// as ObjectIds. Data written by the mgo driver does, but anything inserted by
+// hand with string ids can not be decoded into core.Domain.
+func (store *MongoStore) CheckCompatibility(ctx context.Context) error {
+	cursor, err := store.collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$sample", Value: bson.M{"size": compatibilitySampleSize}}},
+		{{Key: "$project", Value: bson.M{"_id": 1, "parentdomain": 1}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		id := cursor.Current.Lookup("_id")
+		if id.Type != bsontype.ObjectID {
+			return fmt.Errorf("incompatible document: _id %s is a %s, expected an ObjectId", id, id.Type)
+		}
+		parent, err := cursor.Current.LookupErr("parentdomain")
+		if err == nil && parent.Type != bsontype.ObjectID && parent.Type != bsontype.Null {
+			return fmt.Errorf("incompatible document %s: parentdomain is a %s, expected an ObjectId", id, parent.Type)
+		}
+	}
+	return cursor.Err()
+}
+
+// Headers with a value matching the pattern
+func mongoHeaderValueMatch(pattern string) bson.M {
+	regex := primitive.Regex{Pattern: pattern}
+	return bson.M{"$elemMatch": bson.M{"$or": bson.A{
+		bson.M{"value": regex},
+		bson.M{"values": regex},
+	}}}
+}
+
+func mongoQueryFromFilter(filter DomainFilter) bson.M {
+	query := bson.M{}
+	if filter.NamePattern != "" {
+		query["name"] = primitive.Regex{Pattern: filter.NamePattern}
+	}
+	if filter.RegistrableDomain != "" {
+		query["registrabledomain"] = filter.RegistrableDomain
+	}
+	if filter.Technology != "" && filter.HeaderFallback != "" {
+		// Kept apart from the $or the status may need
+		query["$and"] = bson.A{bson.M{"$or": bson.A{
+			bson.M{"technologies.name": filter.Technology},
+			bson.M{"fingerprints": bson.M{"$exists": false}, "headers": mongoHeaderValueMatch(filter.HeaderFallback)},
+		}}}
+	} else if filter.Technology != "" {
+		query["technologies.name"] = filter.Technology
+	}
+	if filter.HeaderValuePattern != "" {
+		query["headers"] = mongoHeaderValueMatch(filter.HeaderValuePattern)
+	} else if filter.CheckedOnly {
+		query["headers"] = bson.M{"$exists": true}
+	}
+	if filter.StatusCode != 0 {
+		query["statuscode"] = filter.StatusCode
+	}
+	if filter.Protocol != "" {
+		query["protocol"] = filter.Protocol
+	}
+	if filter.TLSOnly {
+		query["tls"] = true
+	}
+
+	// Documents from older versions only have skipped or headers set
+	switch filter.Status {
+	case StatusUnchecked:
+	case StatusSkipped:
+		query["status"] = bson.M{"$exists": false}
+		query["skipped"] = true
+	case StatusOK:
+		query["$or"] = bson.A{
+			bson.M{"status": StatusOK},
+			bson.M{"status": bson.M{"$exists": false}, "skipped": bson.M{"$exists": false}, "headers": bson.M{"$exists": true}},
+		}
+	default:
+		query["status"] = filter.Status
+	}
+	if filter.ErrorClass != "" {
+		query["errorclass"] = filter.ErrorClass
+	}
+	return query
+}
+
+func (store *MongoStore) findOne(ctx context.Context, query bson.M) (Domain, error) {
+	var domain Domain
+	err := store.collection.FindOne(ctx, query).Decode(&domain)
+	if err == mongo.ErrNoDocuments {
+		return domain, ErrNotFound
+	}
+	return domain, err
+}
+
+func (store *MongoStore) find(ctx context.Context, query bson.M, findOptions *options.FindOptions) ([]Domain, error) {
+	var domains []Domain
+	cursor, err := store.collection.Find(ctx, query, findOptions)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &domains)
+	return domains, err
+}
+
+func (store *MongoStore) GetDomainById(ctx context.Context, id primitive.ObjectID) (Domain, error) {
+	return store.findOne(ctx, bson.M{"_id": id})
+}
+
+func (store *MongoStore) GetDomainByName(ctx context.Context, name string) (Domain, error) {
+	return store.findOne(ctx, bson.M{"name": name})
+}
+
+func mongoLinksUpsert(name string, links Links) mongo.WriteModel {
+	// $setOnInsert may not be empty on older servers so name is always included
+	onInsert := bson.M{"name": name}
+	if registrable, err := RegistrableDomain(name); err == nil {
+		onInsert["registrabledomain"] = registrable
+	}
+	if !links.Parent.IsZero() {
+		onInsert["parentdomain"] = links.Parent
+	}
+	if len(links.Sources) > 0 {
+		onInsert["discoverysource"] = links.Sources[0]
+	}
+	if links.Port != 0 {
+		onInsert["port"] = links.Port
+	}
+	update := bson.M{"$setOnInsert": onInsert}
+	if len(links.Sources) > 0 {
+		update["$addToSet"] = bson.M{"discoverysources": bson.M{"$each": links.Sources}}
+	}
+	if links.Count > 0 {
+		update["$inc"] = bson.M{"indegree": links.Count}
+	}
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{"name": name}).
+		SetUpdate(update).
+		SetUpsert(true)
+}
+
+// Run the upserts unordered and return the indexes of those that inserted a
+// domain
+func (store *MongoStore) bulkUpsert(ctx context.Context, models []mongo.WriteModel) ([]int, error) {
+	indexes := make([]int, len(models))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	var inserted []int
+	// Two workers inserting the same name at once make one of the upserts
+	// fail on the unique index. Trying it again updates the winner instead.
+	for attempt := 0; attempt < 2 && len(models) > 0; attempt++ {
+		result, err := store.collection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+		if result != nil {
+			for index := range result.UpsertedIDs {
+				inserted = append(inserted, indexes[index])
+			}
+		}
+		if err == nil {
+			return inserted, nil
+		}
+
+		var bulkErr mongo.BulkWriteException
+		if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+			return inserted, err
+		}
+		var retryModels []mongo.WriteModel
+		var retryIndexes []int
+		for _, writeErr := range bulkErr.WriteErrors {
+			if !mongo.IsDuplicateKeyError(writeErr) {
+				return inserted, err
+			}
+			retryModels = append(retryModels, models[writeErr.Index])
+			retryIndexes = append(retryIndexes, indexes[writeErr.Index])
+		}
+		models, indexes = retryModels, retryIndexes
+	}
+	return inserted, nil
+}
+
+func (store *MongoStore) UpsertDiscoveredDomains(ctx context.Context, discoveries []Discovery, parentId primitive.ObjectID) ([]Discovery, error) {
+	if len(discoveries) == 0 {
+		return nil, nil
+	}
+	models := make([]mongo.WriteModel, len(discoveries))
+	for i, discovery := range discoveries {
+		models[i] = mongoLinksUpsert(discovery.Name, discoveryLinks(discovery, parentId))
+	}
+	indexes, err := store.bulkUpsert(ctx, models)
+	inserted := make([]Discovery, 0, len(indexes))
+	for _, index := range indexes {
+		inserted = append(inserted, discoveries[index])
+	}
+	return inserted, err
+}
+
+func (store *MongoStore) AddLinks(ctx context.Context, links map[string]Links) ([]Discovery, error) {
+	if len(links) == 0 {
+		return nil, nil
+	}
+	names := make([]string, 0, len(links))
+	models := make([]mongo.WriteModel, 0, len(links))
+	for name, found := range links {
+		names = append(names, name)
+		models = append(models, mongoLinksUpsert(name, found))
+	}
+	indexes, err := store.bulkUpsert(ctx, models)
+	inserted := make([]Discovery, 0, len(indexes))
+	for _, index := range indexes {
+		inserted = append(inserted, links[names[index]].discovery(names[index]))
+	}
+	return inserted, err
+}
+
+// Unchecked domains have no status, headers or skipped flag
+func mongoToCheckQuery(now time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{
+			"status":  bson.M{"$exists": false},
+			"headers": bson.M{"$exists": false},
+			"skipped": bson.M{"$exists": false},
+		},
+		bson.M{
+			"status":      StatusRetry,
+			"nextattempt": bson.M{"$lte": now},
+		},
+	}}
+}
+
+func mongoUnleasedQuery(now time.Time) bson.M {
+	return bson.M{"$or": bson.A{
+		bson.M{"leaseexpires": bson.M{"$exists": false}},
+		bson.M{"leaseexpires": bson.M{"$lte": now}},
+	}}
+}
+
+// Checked domains that are due under the policy
+func mongoToRecrawlQuery(now time.Time, policy RecrawlPolicy) bson.M {
+	cutoff, popularCutoff := policy.cutoffs(now)
+	due := bson.A{bson.M{"lastchecked": bson.M{"$lt": cutoff}}}
+	if popularCutoff.After(cutoff) {
+		due = append(due, bson.M{
+			"lastchecked": bson.M{"$lt": popularCutoff},
+			"indegree":    bson.M{"$gte": policy.PopularInDegree},
+		})
+	}
+	return bson.M{
+		"$or":    due,
+		"status": bson.M{"$nin": bson.A{StatusIgnored, StatusRetry}},
+	}
+}
+
+// Each domain is leased with its own findAndModify so two workers can never
+// claim the same one
+func (store *MongoStore) claim(ctx context.Context, workerId string, limit int, lease time.Duration, query func(now time.Time) bson.M, findOptions *options.FindOneAndUpdateOptions) ([]Domain, error) {
+	var claimedDomains []Domain
+	for len(claimedDomains) < limit {
+		now := time.Now()
+		var domain Domain
+		err := store.collection.FindOneAndUpdate(
+			ctx,
+			bson.M{"$and": bson.A{query(now), mongoUnleasedQuery(now)}},
+			bson.M{"$set": bson.M{"claimedby": workerId, "leaseexpires": now.Add(lease)}},
+			findOptions.SetReturnDocument(options.After),
+		).Decode(&domain)
+		if err == mongo.ErrNoDocuments {
+			break
+		}
+		if err != nil {
+			return claimedDomains, err
+		}
+		claimedDomains = append(claimedDomains, domain)
+	}
+	return claimedDomains, nil
+}
+
+func (store *MongoStore) ClaimDomainsToCheck(ctx context.Context, workerId string, limit int, lease time.Duration) ([]Domain, error) {
+	return store.claim(ctx, workerId, limit, lease, mongoToCheckQuery, options.FindOneAndUpdate())
+}
+
+func (store *MongoStore) ClaimDomainsToRecrawl(ctx context.Context, workerId string, limit int, lease time.Duration, policy RecrawlPolicy) ([]Domain, error) {
+	return store.claim(
+		ctx, workerId, limit, lease,
+		func(now time.Time) bson.M { return mongoToRecrawlQuery(now, policy) },
+		options.FindOneAndUpdate().SetSort(bson.D{{Key: "lastchecked", Value: 1}}),
+	)
+}
+
+func (store *MongoStore) RenewLeases(ctx context.Context, workerId string, ids []primitive.ObjectID, lease time.Duration) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	_, err := store.collection.UpdateMany(
+		ctx,
+		bson.M{"_id": bson.M{"$in": ids}, "claimedby": workerId},
+		bson.M{"$set": bson.M{"leaseexpires": time.Now().Add(lease)}},
+	)
+	return err
+}
+
+// Keys of every field of a Domain document
+var mongoDomainKeys = bsonKeys(reflect.TypeOf(Domain{}))
+
+// Fields discoveries change while a domain is being crawled, which saving
+// the crawl must leave alone
+var mongoDiscoveryKeys = map[string]bool{"_id": true, "indegree": true, "discoverysources": true}
+
+// Field keys the way the driver names them by default, with inline structs
+// flattened
+func bsonKeys(structType reflect.Type) []string {
+	var keys []string
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key, tagOptions, _ := strings.Cut(field.Tag.Get("bson"), ",")
+		if strings.Contains(tagOptions, "inline") {
+			keys = append(keys, bsonKeys(field.Type)...)
+			continue
+		}
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = strings.ToLower(field.Name)
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// Set the crawl fields of the domain and unset the empty ones
+func mongoDomainUpdate(domain Domain) (bson.M, error) {
+	data, err := bson.Marshal(domain)
+	if err != nil {
+		return nil, err
+	}
+	set := bson.M{}
+	unset := bson.M{}
+	for _, key := range mongoDomainKeys {
+		if mongoDiscoveryKeys[key] {
+			continue
+		}
+		if value, err := bson.Raw(data).LookupErr(key); err == nil {
+			set[key] = value
+		} else {
+			unset[key] = ""
+		}
+	}
+	update := bson.M{"$set": set}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	return update, nil
+}
+
+func (store *MongoStore) UpdateDomain(ctx context.Context, workerId string, domain Domain) error {
+	update, err := mongoDomainUpdate(domain)
+	if err != nil {
+		return err
+	}
+	result, err := store.collection.UpdateOne(ctx, bson.M{"_id": domain.Id, "claimedby": workerId}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount > 0 {
+		return nil
+	}
+	count, err := store.collection.CountDocuments(ctx, bson.M{"_id": domain.Id})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrNotFound
+	}
+	return ErrLeaseLost
+}
+
+func (store *MongoStore) AddObservation(ctx context.Context, observation Observation) (primitive.ObjectID, error) {
+	if observation.Id.IsZero() {
+		observation.Id = primitive.NewObjectID()
+	}
+	_, err := store.observations.InsertOne(ctx, observation)
+	return observation.Id, err
+}
+
+func (store *MongoStore) ListObservations(ctx context.Context, domainId primitive.ObjectID) ([]Observation, error) {
+	var observations []Observation
+	cursor, err := store.observations.Find(
+		ctx,
+		bson.M{"domainid": domainId},
+		options.Find().SetSort(bson.D{{Key: "time", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &observations)
+	return observations, err
+}
+
+func (store *MongoStore) AddSubdomain(ctx context.Context, name string, maxSubdomains int) (Site, error) {
+	var site Site
+	err := store.sites.FindOneAndUpdate(
+		ctx,
+		bson.M{"_id": name},
+		bson.M{"$inc": bson.M{"subdomains": 1}},
+		options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After),
+	).Decode(&site)
+	if err != nil || !shouldQuarantine(site, maxSubdomains) {
+		return site, err
+	}
+	site.Quarantined = true
+	site.QuarantinedAt = time.Now()
+	_, err = store.sites.UpdateOne(
+		ctx,
+		bson.M{"_id": name, "released": bson.M{"$ne": true}},
+		bson.M{"$set": bson.M{"quarantined": true, "quarantinedat": site.QuarantinedAt}},
+	)
+	return site, err
+}
+
+func (store *MongoStore) ListQuarantinedSites(ctx context.Context) ([]Site, error) {
+	var sites []Site
+	cursor, err := store.sites.Find(
+		ctx,
+		bson.M{"quarantined": true},
+		options.Find().SetSort(bson.D{{Key: "subdomains", Value: -1}}),
+	)
+	if err != nil {
+		return nil, err
+	}
+	err = cursor.All(ctx, &sites)
+	return sites, err
+}
+
+func (store *MongoStore) ReleaseSite(ctx context.Context, name string) error {
+	_, err := store.sites.UpdateOne(
+		ctx,
+		bson.M{"_id": name},
+		bson.M{
+			"$set":   bson.M{"released": true},
+			"$unset": bson.M{"quarantined": "", "quarantinedat": ""},
+		},
+		options.Update().SetUpsert(true),
+	)
+	if err != nil {
+		return err
+	}
+	_, err = store.collection.UpdateMany(
+		ctx,
+		bson.M{"registrabledomain": name, "status": StatusIgnored},
+		bson.M{"$unset": bson.M{"status": "", "errorclass": "", "errormessage": "", "skipped": ""}},
+	)
+	return err
+}
+
+func (store *MongoStore) ListDomains(ctx context.Context, filter DomainFilter, skip int, limit int) ([]Domain, error) {
+	return store.find(
+		ctx,
+		mongoQueryFromFilter(filter),
+		options.Find().SetSkip(int64(skip)).SetLimit(int64(limit)),
+	)
+}
+
+func (store *MongoStore) ForEachDomainName(ctx context.Context, fn func(name string) error) error {
+	cursor, err := store.collection.Find(
+		ctx,
+		bson.M{},
+		options.Find().SetProjection(bson.M{"_id": 0, "name": 1}).SetBatchSize(10000),
+	)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		name, ok := cursor.Current.Lookup("name").StringValueOK()
+		if !ok {
+			continue
+		}
+		if err = fn(name); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (store *MongoStore) CountDomains(ctx context.Context, filter DomainFilter) (int, error) {
+	var (
+		count int64
+		err   error
+	)
+	if filter == (DomainFilter{}) {
+		count, err = store.collection.EstimatedDocumentCount(ctx)
+	} else {
+		count, err = store.collection.CountDocuments(ctx, mongoQueryFromFilter(filter))
+	}
+	return int(count), err
+}
+
+func (store *MongoStore) CountByStatus(ctx context.Context) ([]StatusCount, error) {
+	cursor, err := store.collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{
+				"status":     "$status",
+				"errorclass": "$errorclass",
+				"skipped":    "$skipped",
+				"hasheaders": bson.M{"$isArray": "$headers"},
+			},
+			"count": bson.M{"$sum": 1},
+		}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	var groups []struct {
+		Id struct {
+			Status     CrawlStatus
+			ErrorClass string
+			Skipped    bool
+			HasHeaders bool
+		} `bson:"_id"`
+		Count int
+	}
+	if err = cursor.All(ctx, &groups); err != nil {
+		return nil, err
+	}
+
+	var counts []StatusCount
+	for _, group := range groups {
+		status := effectiveStatus(group.Id.Status, group.Id.Skipped, group.Id.HasHeaders)
+		counts = mergeStatusCount(counts, status, group.Id.ErrorClass, group.Count)
+	}
+	sortStatusCounts(counts)
+	return counts, nil
+}
+
+func (store *MongoStore) Close() {
+	store.client.Disconnect(context.Background())
+}
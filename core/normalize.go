@@ -0,0 +1,99 @@
+package core
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/net/publicsuffix"
+)
+
+var ErrInvalidDomainName = errors.New("invalid domain name")
+
+const (
+	maxDomainNameLength = 253
+	maxLabelLength      = 63
+)
+
+// Bring a host name into the form domains are stored in: lower case without
+// a trailing dot or port and with international names in punycode. Names
+// that are IP addresses, break the RFC 1035 rules or are not below a known
+// public suffix are rejected.
+func NormalizeDomainName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || net.ParseIP(name) != nil {
+		return "", ErrInvalidDomainName
+	}
+
+	name, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", ErrInvalidDomainName
+	}
+	name = strings.ToLower(name)
+	if !validLabels(name) {
+		return "", ErrInvalidDomainName
+	}
+
+	suffix, known := icannSuffix(name)
+	if !known || suffix == name { // e.g. a.bc or co.uk
+		return "", ErrInvalidDomainName
+	}
+	return name, nil
+}
+
+// Letters, digits and hyphens, 1 to 63 characters per label, not starting or
+// ending with a hyphen, and no more than 253 characters in total
+func validLabels(name string) bool {
+	if len(name) > maxDomainNameLength {
+		return false
+	}
+	labels := strings.Split(name, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > maxLabelLength || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// The ICANN public suffix of a name and whether it is on the list at all.
+// Private suffixes like blogspot.com are skipped so that their subdomains
+// group under the hosting site, which is what politeness and black hole
+// detection need.
+func icannSuffix(name string) (string, bool) {
+	suffix, icann := publicsuffix.PublicSuffix(name)
+	for !icann {
+		dot := strings.IndexByte(suffix, '.')
+		if dot == -1 { // Only matched the default * rule
+			return suffix, false
+		}
+		suffix, icann = publicsuffix.PublicSuffix(suffix[dot+1:])
+	}
+	return suffix, true
+}
+
+// The part of a normalized name that can be registered, one label below its
+// public suffix, e.g. www.example.co.uk -> example.co.uk
+func RegistrableDomain(name string) (string, error) {
+	suffix, _ := icannSuffix(name)
+	end := len(name) - len(suffix) - 1
+	if end <= 0 || name[end] != '.' {
+		return "", ErrInvalidDomainName
+	}
+	start := strings.LastIndexByte(name[:end], '.') + 1
+	return name[start:], nil
+}
@@ -0,0 +1,97 @@
+package core
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeDomainName(t *testing.T) {
+	longLabel := strings.Repeat("a", maxLabelLength)
+	longName := strings.Repeat(longLabel+".", 4)[:maxDomainNameLength-len(".com")] + ".com"
+	tests := []struct {
+		name string
+		want string // Empty if the name is invalid
+	}{
+		{"example.com", "example.com"},
+		{"WWW.Example.COM", "www.example.com"},
+		{"example.com.", "example.com"},
+		{" example.com ", "example.com"},
+		{"example.com:8080", "example.com"},
+		{"Example.com.:443", "example.com"},
+		{"münchen.de", "xn--mnchen-3ya.de"},
+		{"MÜNCHEN.de", "xn--mnchen-3ya.de"},
+		{"xn--mnchen-3ya.de", "xn--mnchen-3ya.de"},
+		{"例え.jp", "xn--r8jz45g.jp"},
+		{"127.0.0.1", ""},
+		{"127.0.0.1:80", ""},
+		{"::1", ""},
+		{"[2001:db8::1]:443", ""},
+		{"co.uk", ""},
+		{"www.co.uk", "www.co.uk"},
+		{"a.bc", ""},
+		{"com", ""},
+		{"localhost", ""},
+		{"foo.blogspot.com", "foo.blogspot.com"},
+		{"blogspot.com", "blogspot.com"},
+		{"", ""},
+		{".", ""},
+		{longLabel + ".com", longLabel + ".com"},
+		{"a" + longLabel + ".com", ""},
+		{longName, longName},
+		{"a" + longName, ""},
+		{"my-site.com", "my-site.com"},
+		{"-site.com", ""},
+		{"site-.com", ""},
+		{"a..com", ""},
+		{"under_score.com", ""},
+		{"sp ace.com", ""},
+		{"ex!ample.com", ""},
+	}
+	for _, test := range tests {
+		got, err := NormalizeDomainName(test.name)
+		if test.want == "" {
+			if err != ErrInvalidDomainName {
+				t.Errorf("NormalizeDomainName(%q) = %q, %v, want ErrInvalidDomainName", test.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("NormalizeDomainName(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestRegistrableDomain(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   string // Empty if the name has no registrable part
+		suffix string
+		known  bool
+	}{
+		{"example.com", "example.com", "com", true},
+		{"www.example.com", "example.com", "com", true},
+		{"a.b.c.example.com", "example.com", "com", true},
+		{"www.example.co.uk", "example.co.uk", "co.uk", true},
+		{"foo.blogspot.com", "blogspot.com", "com", true},
+		{"foo.bar.github.io", "github.io", "io", true},
+		{"xn--mnchen-3ya.de", "xn--mnchen-3ya.de", "de", true},
+		{"co.uk", "", "co.uk", true},
+		{"com", "", "com", true},
+		{"a.bc", "a.bc", "bc", false}, // Only the default * rule matches
+	}
+	for _, test := range tests {
+		if suffix, known := icannSuffix(test.name); suffix != test.suffix || known != test.known {
+			t.Errorf("icannSuffix(%q) = %q, %v, want %q, %v", test.name, suffix, known, test.suffix, test.known)
+		}
+		got, err := RegistrableDomain(test.name)
+		if test.want == "" {
+			if err != ErrInvalidDomainName {
+				t.Errorf("RegistrableDomain(%q) = %q, %v, want ErrInvalidDomainName", test.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("RegistrableDomain(%q) = %q, %v, want %q", test.name, got, err, test.want)
+		}
+	}
+}
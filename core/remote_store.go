@@ -0,0 +1,228 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrReadOnly        = errors.New("store is read only")
+	errRemoteNotServed = errors.New("not served over HTTP")
+)
+
+// Arguments of every method a StoreServer answers, sent as BSON
+type remoteRequest struct {
+	Id     primitive.ObjectID `bson:",omitempty"`
+	Name   string             `bson:",omitempty"`
+	Filter DomainFilter
+	Skip   int
+	Limit  int
+}
+
+// Results of every method a StoreServer answers, sent as BSON
+type remoteResponse struct {
+	Domain       Domain
+	Domains      []Domain      `bson:",omitempty"`
+	Observations []Observation `bson:",omitempty"`
+	Sites        []Site        `bson:",omitempty"`
+	StatusCounts []StatusCount `bson:",omitempty"`
+	Count        int
+}
+
+// Serves the read only methods of a store over HTTP. The worker uses it to
+// share a Bolt file it has open with the website, which can not open the
+// file itself while the worker runs.
+type StoreServer struct {
+	store DomainStore
+}
+
+func NewStoreServer(store DomainStore) *StoreServer {
+	return &StoreServer{store: store}
+}
+
+// Each method is a POST to its name, e.g. /ListDomains
+func (server *StoreServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request remoteRequest
+	if err = bson.Unmarshal(data, &request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var response remoteResponse
+	ctx := r.Context()
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case "GetDomainById":
+		response.Domain, err = server.store.GetDomainById(ctx, request.Id)
+	case "GetDomainByName":
+		response.Domain, err = server.store.GetDomainByName(ctx, request.Name)
+	case "ListObservations":
+		response.Observations, err = server.store.ListObservations(ctx, request.Id)
+	case "ListQuarantinedSites":
+		response.Sites, err = server.store.ListQuarantinedSites(ctx)
+	case "ListDomains":
+		response.Domains, err = server.store.ListDomains(ctx, request.Filter, request.Skip, request.Limit)
+	case "CountDomains":
+		response.Count, err = server.store.CountDomains(ctx, request.Filter)
+	case "CountByStatus":
+		response.StatusCounts, err = server.store.CountByStatus(ctx)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err == ErrNotFound {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if data, err = bson.Marshal(response); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/bson")
+	w.Write(data)
+}
+
+// DomainStore reading from a StoreServer. Every write returns ErrReadOnly.
+type RemoteStore struct {
+	url    string
+	client *http.Client
+}
+
+func NewRemoteStore(url string) (*RemoteStore, error) {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("worker URL %s must start with http:// or https://", url)
+	}
+	return &RemoteStore{url: strings.TrimSuffix(url, "/"), client: &http.Client{Timeout: time.Minute}}, nil
+}
+
+func (store *RemoteStore) call(ctx context.Context, method string, request remoteRequest) (remoteResponse, error) {
+	var response remoteResponse
+	data, err := bson.Marshal(request)
+	if err != nil {
+		return response, err
+	}
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, store.url+"/"+method, bytes.NewReader(data))
+	if err != nil {
+		return response, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/bson")
+	httpResponse, err := store.client.Do(httpRequest)
+	if err != nil {
+		return response, err
+	}
+	defer httpResponse.Body.Close()
+	data, err = io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return response, err
+	}
+	switch httpResponse.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return response, ErrNotFound
+	default:
+		return response, fmt.Errorf("%s: %s %s", method, httpResponse.Status, strings.TrimSpace(string(data)))
+	}
+	err = bson.Unmarshal(data, &response)
+	return response, err
+}
+
+func (store *RemoteStore) GetDomainById(ctx context.Context, id primitive.ObjectID) (Domain, error) {
+	response, err := store.call(ctx, "GetDomainById", remoteRequest{Id: id})
+	return response.Domain, err
+}
+
+func (store *RemoteStore) GetDomainByName(ctx context.Context, name string) (Domain, error) {
+	response, err := store.call(ctx, "GetDomainByName", remoteRequest{Name: name})
+	return response.Domain, err
+}
+
+func (store *RemoteStore) UpsertDiscoveredDomains(ctx context.Context, discoveries []Discovery, parentId primitive.ObjectID) ([]Discovery, error) {
+	return nil, ErrReadOnly
+}
+
+func (store *RemoteStore) AddLinks(ctx context.Context, links map[string]Links) ([]Discovery, error) {
+	return nil, ErrReadOnly
+}
+
+func (store *RemoteStore) ClaimDomainsToCheck(ctx context.Context, workerId string, limit int, lease time.Duration) ([]Domain, error) {
+	return nil, ErrReadOnly
+}
+
+func (store *RemoteStore) ClaimDomainsToRecrawl(ctx context.Context, workerId string, limit int, lease time.Duration, policy RecrawlPolicy) ([]Domain, error) {
+	return nil, ErrReadOnly
+}
+
+func (store *RemoteStore) RenewLeases(ctx context.Context, workerId string, ids []primitive.ObjectID, lease time.Duration) error {
+	return ErrReadOnly
+}
+
+func (store *RemoteStore) UpdateDomain(ctx context.Context, workerId string, domain Domain) error {
+	return ErrReadOnly
+}
+
+func (store *RemoteStore) AddObservation(ctx context.Context, observation Observation) (primitive.ObjectID, error) {
+	return primitive.NilObjectID, ErrReadOnly
+}
+
+func (store *RemoteStore) ListObservations(ctx context.Context, domainId primitive.ObjectID) ([]Observation, error) {
+	response, err := store.call(ctx, "ListObservations", remoteRequest{Id: domainId})
+	return response.Observations, err
+}
+
+func (store *RemoteStore) AddSubdomain(ctx context.Context, site string, maxSubdomains int) (Site, error) {
+	return Site{}, ErrReadOnly
+}
+
+func (store *RemoteStore) ListQuarantinedSites(ctx context.Context) ([]Site, error) {
+	response, err := store.call(ctx, "ListQuarantinedSites", remoteRequest{})
+	return response.Sites, err
+}
+
+func (store *RemoteStore) ReleaseSite(ctx context.Context, site string) error {
+	return ErrReadOnly
+}
+
+func (store *RemoteStore) ListDomains(ctx context.Context, filter DomainFilter, skip int, limit int) ([]Domain, error) {
+	response, err := store.call(ctx, "ListDomains", remoteRequest{Filter: filter, Skip: skip, Limit: limit})
+	return response.Domains, err
+}
+
+// Walking every name would mean one request per name or one huge response
+func (store *RemoteStore) ForEachDomainName(ctx context.Context, fn func(name string) error) error {
+	return errRemoteNotServed
+}
+
+func (store *RemoteStore) CountDomains(ctx context.Context, filter DomainFilter) (int, error) {
+	response, err := store.call(ctx, "CountDomains", remoteRequest{Filter: filter})
+	return response.Count, err
+}
+
+func (store *RemoteStore) CountByStatus(ctx context.Context) ([]StatusCount, error) {
+	response, err := store.call(ctx, "CountByStatus", remoteRequest{})
+	return response.StatusCounts, err
+}
+
+func (store *RemoteStore) Close() {
+	store.client.CloseIdleConnections()
+}
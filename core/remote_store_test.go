@@ -0,0 +1,84 @@
+package core
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestRemoteStoreReadsThroughServer(t *testing.T) {
+	ctx := context.Background()
+	store := openTestBoltStore(t)
+	_, err := store.UpsertDiscoveredDomains(ctx, []Discovery{
+		{Name: "example.com", Source: SourceSeed},
+		{Name: "www.example.com", Source: SourceAnchor},
+	}, primitive.NilObjectID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	domain := claimTestDomain(t, store, "example.com")
+	domain.Status = StatusOK
+	domain.LastChecked = time.Now()
+	domain.Headers = []Header{{Key: "Server", Value: "nginx/1.18.0"}}
+	if err = store.UpdateDomain(ctx, "test", domain); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = store.AddObservation(ctx, Observation{DomainId: domain.Id, Time: domain.LastChecked, Headers: domain.Headers}); err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(NewStoreServer(store))
+	defer server.Close()
+	remote, err := NewRemoteStore(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	got, err := remote.GetDomainById(ctx, domain.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "example.com" || got.Status != StatusOK || len(got.Headers) != 1 || !got.LastChecked.Equal(domain.LastChecked.Truncate(time.Millisecond)) {
+		t.Errorf("GetDomainById returned %+v", got)
+	}
+	if _, err = remote.GetDomainByName(ctx, "missing.example.com"); err != ErrNotFound {
+		t.Errorf("GetDomainByName of a missing domain returned %v, want ErrNotFound", err)
+	}
+
+	domains, err := remote.ListDomains(ctx, DomainFilter{HeaderValuePattern: "^nginx"}, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(domains) != 1 || domains[0].Id != domain.Id {
+		t.Errorf("ListDomains returned %+v", domains)
+	}
+	count, err := remote.CountDomains(ctx, DomainFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("CountDomains returned %d, want 2", count)
+	}
+	counts, err := remote.CountByStatus(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 2 {
+		t.Errorf("CountByStatus returned %+v", counts)
+	}
+	observations, err := remote.ListObservations(ctx, domain.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(observations) != 1 {
+		t.Errorf("ListObservations returned %d observations, want 1", len(observations))
+	}
+
+	if err = remote.UpdateDomain(ctx, "test", domain); err != ErrReadOnly {
+		t.Errorf("UpdateDomain returned %v, want ErrReadOnly", err)
+	}
+}
@@ -0,0 +1,212 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var (
+	ErrNotFound  = errors.New("domain not found")
+	ErrLeaseLost = errors.New("domain leased by another worker")
+)
+
+// Criteria for listing and counting domains. Empty fields match everything.
+// Patterns are regular expressions; use an inline (?i) for case insensitivity.
+type DomainFilter struct {
+	NamePattern        string
+	RegistrableDomain  string
+	HeaderValuePattern string
+	Technology         string // Name of a detected technology, e.g. Nginx
+	HeaderFallback     string // With Technology, a header value pattern for domains crawled before fingerprinting
+	CheckedOnly        bool   // Only domains that have headers stored
+	StatusCode         int
+	Protocol           string
+	TLSOnly            bool
+	Status             CrawlStatus // Compared with Domain.CrawlStatus(), so StatusUnchecked is ignored
+	ErrorClass         string
+}
+
+// Number of domains with a crawl status and error class
+type StatusCount struct {
+	Status     CrawlStatus
+	ErrorClass string
+	Count      int
+}
+
+// DomainStore is implemented by every storage backend for core.Domain
+type DomainStore interface {
+	GetDomainById(ctx context.Context, id primitive.ObjectID) (Domain, error)
+	GetDomainByName(ctx context.Context, name string) (Domain, error)
+
+	// Insert the newly discovered domains that do not exist yet in one round
+	// trip. Names must be normalized with NormalizeDomainName first and be
+	// unique. Returns the discoveries that were inserted. The source of every
+	// discovery is added to DiscoverySources and the InDegree of every domain
+	// is raised when parentId is set.
+	UpsertDiscoveredDomains(ctx context.Context, discoveries []Discovery, parentId primitive.ObjectID) ([]Discovery, error)
+
+	// Raise the InDegree of domains by the number of new links to them and
+	// add their sources, keyed by name. Domains that do not exist yet are
+	// created like by UpsertDiscoveredDomains, with the Parent and Port of the
+	// links and their first source. Returns the discoveries that were inserted.
+	AddLinks(ctx context.Context, links map[string]Links) ([]Discovery, error)
+
+	// Lease up to limit domains that have not been checked yet or are due to
+	// be retried to workerId. Domains leased by another worker are left alone
+	// until their lease expires, so a crashed worker's domains are reclaimed.
+	ClaimDomainsToCheck(ctx context.Context, workerId string, limit int, lease time.Duration) ([]Domain, error)
+
+	// Lease up to limit checked domains that are due to be crawled again,
+	// least recently checked first
+	ClaimDomainsToRecrawl(ctx context.Context, workerId string, limit int, lease time.Duration, policy RecrawlPolicy) ([]Domain, error)
+
+	// Extend the leases workerId still holds on the given domains
+	RenewLeases(ctx context.Context, workerId string, ids []primitive.ObjectID, lease time.Duration) error
+
+	// Save the result of crawling a domain. Clear ClaimedBy and LeaseExpires
+	// first to release the lease. Returns ErrLeaseLost without saving anything
+	// unless the stored domain is still claimed by workerId, e.g. when the
+	// lease expired and another worker claimed the domain. InDegree and
+	// DiscoverySources are kept as stored.
+	UpdateDomain(ctx context.Context, workerId string, domain Domain) error
+
+	// Store a crawl snapshot and return its id. The domain itself is not
+	// changed; set LatestObservation and call UpdateDomain for that.
+	AddObservation(ctx context.Context, observation Observation) (primitive.ObjectID, error)
+
+	// All snapshots of a domain, newest first
+	ListObservations(ctx context.Context, domainId primitive.ObjectID) ([]Observation, error)
+
+	// Count a new subdomain of site and quarantine the site once it has more
+	// than maxSubdomains, unless it was released. Returns the updated site.
+	AddSubdomain(ctx context.Context, site string, maxSubdomains int) (Site, error)
+
+	// Sites with too many subdomains, most subdomains first
+	ListQuarantinedSites(ctx context.Context) ([]Site, error)
+
+	// Lift the quarantine of a site for good and make its ignored domains
+	// unchecked again so they are crawled
+	ReleaseSite(ctx context.Context, site string) error
+
+	ListDomains(ctx context.Context, filter DomainFilter, skip int, limit int) ([]Domain, error)
+
+	// Call fn with the name of every domain, stopping at the first error
+	ForEachDomainName(ctx context.Context, fn func(name string) error) error
+
+	CountDomains(ctx context.Context, filter DomainFilter) (int, error)
+	CountByStatus(ctx context.Context) ([]StatusCount, error)
+
+	Close()
+}
+
+// When checked domains are crawled again. Domains that were ignored or are
+// waiting for a retry are never recrawled.
+type RecrawlPolicy struct {
+	MaxAge          time.Duration // Recrawl domains last checked longer ago than this
+	PopularMaxAge   time.Duration // Shorter age used for popular domains
+	PopularInDegree int           // Domains found at least this often are popular, 0 to treat none as popular
+}
+
+// Whether a checked domain may be recrawled at all
+func isRecrawlable(domain Domain) bool {
+	status := domain.CrawlStatus()
+	return !domain.LastChecked.IsZero() && status != StatusIgnored && status != StatusRetry
+}
+
+// Oldest LastChecked that is not yet due under the policy, for popular and
+// for other domains
+func (policy RecrawlPolicy) cutoffs(now time.Time) (time.Time, time.Time) {
+	cutoff := now.Add(-policy.MaxAge)
+	popularCutoff := cutoff
+	if policy.PopularInDegree > 0 && policy.PopularMaxAge < policy.MaxAge {
+		popularCutoff = now.Add(-policy.PopularMaxAge)
+	}
+	return cutoff, popularCutoff
+}
+
+func (policy RecrawlPolicy) isDue(domain Domain, now time.Time) bool {
+	cutoff, popularCutoff := policy.cutoffs(now)
+	if policy.PopularInDegree > 0 && domain.InDegree >= policy.PopularInDegree {
+		cutoff = popularCutoff
+	}
+	return isRecrawlable(domain) && domain.LastChecked.Before(cutoff)
+}
+
+func shouldQuarantine(site Site, maxSubdomains int) bool {
+	return maxSubdomains > 0 && site.Subdomains > maxSubdomains && !site.Quarantined && !site.Released
+}
+
+// Add count to the entry for status and errorClass, creating it if needed
+func mergeStatusCount(counts []StatusCount, status CrawlStatus, errorClass string, count int) []StatusCount {
+	for i := range counts {
+		if counts[i].Status == status && counts[i].ErrorClass == errorClass {
+			counts[i].Count += count
+			return counts
+		}
+	}
+	return append(counts, StatusCount{Status: status, ErrorClass: errorClass, Count: count})
+}
+
+func sortStatusCounts(counts []StatusCount) {
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Status != counts[j].Status {
+			return counts[i].Status < counts[j].Status
+		}
+		return counts[i].ErrorClass < counts[j].ErrorClass
+	})
+}
+
+// Connection settings for the storage backends. Host, Database, Collection
+// and PoolSize are used by the mongo backend, File by the bolt backend and
+// URL by the worker backend, which reads from a worker's StoreServer.
+type StoreOptions struct {
+	Backend    string
+	Host       string
+	Database   string
+	Collection string
+	PoolSize   uint64 // Maximum open connections, 0 for the driver default
+	File       string
+	URL        string
+	ReadOnly   bool
+}
+
+// Name of the domains the options open, the same for every process using them
+func (options StoreOptions) Identity() string {
+	switch options.Backend {
+	case "mongo", "":
+		return "mongo://" + options.Host + "/" + options.Database + "/" + options.Collection
+	case "bolt":
+		if path, err := filepath.Abs(options.File); err == nil {
+			return "bolt://" + path
+		}
+		return "bolt://" + options.File
+	}
+	return options.URL
+}
+
+func OpenDomainStore(ctx context.Context, options StoreOptions) (DomainStore, error) {
+	var (
+		store DomainStore
+		err   error
+	)
+	switch options.Backend {
+	case "mongo", "":
+		store, err = NewMongoStore(ctx, options.Host, options.Database, options.Collection, options.PoolSize)
+	case "bolt":
+		store, err = NewBoltStore(options.File, options.ReadOnly)
+	case "worker":
+		store, err = NewRemoteStore(options.URL)
+	default:
+		err = fmt.Errorf("unknown storage backend: %s", options.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
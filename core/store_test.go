@@ -0,0 +1,534 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Run the test against every backend. MongoDB is only used when MONGO_URL
+// is set, e.g. MONGO_URL=localhost:27017, with a database dropped afterwards.
+func forEachStore(t *testing.T, test func(t *testing.T, store DomainStore)) {
+	t.Run("bolt", func(t *testing.T) {
+		test(t, openTestBoltStore(t))
+	})
+	t.Run("mongo", func(t *testing.T) {
+		url := os.Getenv("MONGO_URL")
+		if url == "" {
+			t.Skip("MONGO_URL not set")
+		}
+		test(t, openTestMongoStore(t, url))
+	})
+}
+
+func openTestMongoStore(t *testing.T, url string) *MongoStore {
+	t.Helper()
+	ctx := context.Background()
+	database := "webgenome_test_" + primitive.NewObjectID().Hex()
+	store, err := NewMongoStore(ctx, url, database, "domains", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := store.client.Database(database).Drop(ctx); err != nil {
+			t.Error(err)
+		}
+		store.Close()
+	})
+	return store
+}
+
+func upsertTestDomains(t *testing.T, store DomainStore, parentId primitive.ObjectID, names ...string) []Discovery {
+	t.Helper()
+	discoveries := make([]Discovery, len(names))
+	for i, name := range names {
+		discoveries[i] = Discovery{Name: name, Source: SourceAnchor}
+	}
+	inserted, err := store.UpsertDiscoveredDomains(context.Background(), discoveries, parentId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return inserted
+}
+
+func getTestDomain(t *testing.T, store DomainStore, name string) Domain {
+	t.Helper()
+	domain, err := store.GetDomainByName(context.Background(), name)
+	if err != nil {
+		t.Fatalf("getting %s: %v", name, err)
+	}
+	return domain
+}
+
+// Lease the named domain to the worker "test" so it can be saved
+func claimTestDomain(t *testing.T, store DomainStore, name string) Domain {
+	t.Helper()
+	domains, err := store.ClaimDomainsToCheck(context.Background(), "test", 100, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range domains {
+		if domain.Name == name {
+			return domain
+		}
+	}
+	t.Fatalf("could not claim %s", name)
+	return Domain{}
+}
+
+// Claim every unchecked domain as "test", change it with update and save it
+// with its lease released
+func saveTestDomains(t *testing.T, store DomainStore, update func(domain *Domain)) {
+	t.Helper()
+	ctx := context.Background()
+	domains, err := store.ClaimDomainsToCheck(ctx, "test", 100, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, domain := range domains {
+		update(&domain)
+		domain.ClaimedBy = ""
+		domain.LeaseExpires = time.Time{}
+		if err = store.UpdateDomain(ctx, "test", domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func domainNames(domains []Domain) string {
+	names := make([]string, len(domains))
+	for i, domain := range domains {
+		names[i] = domain.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestStoreUpsertDiscoveredDomains(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store DomainStore) {
+		inserted := upsertTestDomains(t, store, primitive.NilObjectID, "a.example.com", "b.example.com")
+		if len(inserted) != 2 {
+			t.Errorf("inserted %d new domains, want 2", len(inserted))
+		}
+		if domain := getTestDomain(t, store, "a.example.com"); domain.InDegree != 0 || domain.RegistrableDomain != "example.com" {
+			t.Errorf("seeded domain has InDegree %d and site %q", domain.InDegree, domain.RegistrableDomain)
+		}
+
+		// Only new names are returned but every name found counts a link
+		parent := getTestDomain(t, store, "a.example.com").Id
+		inserted = upsertTestDomains(t, store, parent, "b.example.com", "c.example.com")
+		if len(inserted) != 1 || inserted[0].Name != "c.example.com" {
+			t.Errorf("inserted %+v, want only c.example.com", inserted)
+		}
+		upsertTestDomains(t, store, parent, "b.example.com")
+		for name, want := range map[string]int{"a.example.com": 0, "b.example.com": 2, "c.example.com": 1} {
+			if domain := getTestDomain(t, store, name); domain.InDegree != want {
+				t.Errorf("%s has InDegree %d, want %d", name, domain.InDegree, want)
+			}
+		}
+		if domain := getTestDomain(t, store, "c.example.com"); domain.ParentDomain != parent {
+			t.Errorf("ParentDomain is %s, want %s", domain.ParentDomain.Hex(), parent.Hex())
+		}
+
+		inserted, err := store.AddLinks(context.Background(), map[string]Links{
+			"b.example.com":       {Count: 3},
+			"missing.example.com": {Count: 1, Sources: []string{SourceScript}, Parent: parent, Port: 8080},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(inserted) != 1 || inserted[0] != (Discovery{Name: "missing.example.com", Port: 8080, Source: SourceScript}) {
+			t.Errorf("adding links inserted %+v, want only missing.example.com", inserted)
+		}
+		if domain := getTestDomain(t, store, "b.example.com"); domain.InDegree != 5 {
+			t.Errorf("InDegree is %d after adding links, want 5", domain.InDegree)
+		}
+		// Links to a name the store does not know yet create it
+		missing := getTestDomain(t, store, "missing.example.com")
+		if missing.InDegree != 1 || missing.ParentDomain != parent || missing.Port != 8080 ||
+			missing.DiscoverySource != SourceScript || missing.RegistrableDomain != "example.com" {
+			t.Errorf("domain created by adding links is %+v", missing)
+		}
+	})
+}
+
+func TestStoreDiscoverySources(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		parent := primitive.NewObjectID()
+		for _, source := range []string{SourceAnchor, SourceScript, SourceAnchor} {
+			if _, err := store.UpsertDiscoveredDomains(ctx, []Discovery{{Name: "example.com", Source: source}}, parent); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := store.AddLinks(ctx, map[string]Links{"example.com": {Count: 2, Sources: []string{SourceImage, SourceScript}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		domain := getTestDomain(t, store, "example.com")
+		if domain.DiscoverySource != SourceAnchor {
+			t.Errorf("DiscoverySource is %q, want the first source", domain.DiscoverySource)
+		}
+		want := []string{SourceAnchor, SourceScript, SourceImage}
+		if strings.Join(domain.DiscoverySources, ",") != strings.Join(want, ",") {
+			t.Errorf("DiscoverySources are %v, want %v", domain.DiscoverySources, want)
+		}
+		if domain.InDegree != 5 {
+			t.Errorf("InDegree is %d, want 5", domain.InDegree)
+		}
+	})
+}
+
+func TestStoreClaimDomainsToCheckOnce(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store DomainStore) {
+		var names []string
+		for i := 0; i < 40; i++ {
+			names = append(names, fmt.Sprintf("d%d.example.com", i))
+		}
+		upsertTestDomains(t, store, primitive.NilObjectID, names...)
+
+		var (
+			mutex   sync.Mutex
+			claimed = make(map[string]string)
+			workers sync.WaitGroup
+		)
+		for i := 0; i < 4; i++ {
+			workers.Add(1)
+			go func(workerId string) {
+				defer workers.Done()
+				for {
+					domains, err := store.ClaimDomainsToCheck(context.Background(), workerId, 3, time.Minute)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if len(domains) == 0 {
+						return
+					}
+					mutex.Lock()
+					for _, domain := range domains {
+						if other, found := claimed[domain.Name]; found {
+							t.Errorf("%s claimed by %s and %s", domain.Name, other, workerId)
+						}
+						if domain.ClaimedBy != workerId {
+							t.Errorf("%s returned to %s with ClaimedBy %q", domain.Name, workerId, domain.ClaimedBy)
+						}
+						claimed[domain.Name] = workerId
+					}
+					mutex.Unlock()
+				}
+			}(fmt.Sprintf("worker-%d", i))
+		}
+		workers.Wait()
+		if len(claimed) != len(names) {
+			t.Errorf("claimed %d domains, want %d", len(claimed), len(names))
+		}
+	})
+}
+
+func TestStoreExpiredLeasesAreReclaimed(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		upsertTestDomains(t, store, primitive.NilObjectID, "example.com")
+		first, err := store.ClaimDomainsToCheck(ctx, "first", 10, 100*time.Millisecond)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(first) != 1 {
+			t.Fatalf("first worker claimed %d domains, want 1", len(first))
+		}
+		second, err := store.ClaimDomainsToCheck(ctx, "second", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(second) != 0 {
+			t.Fatalf("second worker claimed %s while it was leased", domainNames(second))
+		}
+
+		time.Sleep(200 * time.Millisecond)
+		second, err = store.ClaimDomainsToCheck(ctx, "second", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(second) != 1 || second[0].ClaimedBy != "second" {
+			t.Fatalf("second worker claimed %+v after the lease expired", second)
+		}
+
+		// Only the worker holding the lease may save the result
+		domain := first[0]
+		domain.Status = StatusOK
+		domain.ClaimedBy = ""
+		if err = store.UpdateDomain(ctx, "first", domain); err != ErrLeaseLost {
+			t.Errorf("saving with the expired lease returned %v, want ErrLeaseLost", err)
+		}
+		domain = second[0]
+		domain.Status = StatusFailed
+		domain.ClaimedBy = ""
+		domain.LeaseExpires = time.Time{}
+		if err = store.UpdateDomain(ctx, "second", domain); err != nil {
+			t.Fatal(err)
+		}
+		if saved := getTestDomain(t, store, "example.com"); saved.Status != StatusFailed {
+			t.Errorf("Status is %q, want the second worker's result", saved.Status)
+		}
+		// Saving released the lease so a second save is refused
+		if err = store.UpdateDomain(ctx, "second", domain); err != ErrLeaseLost {
+			t.Errorf("saving a released domain returned %v, want ErrLeaseLost", err)
+		}
+		if err = store.UpdateDomain(ctx, "second", Domain{Id: primitive.NewObjectID()}); err != ErrNotFound {
+			t.Errorf("saving a missing domain returned %v, want ErrNotFound", err)
+		}
+	})
+}
+
+func TestStoreUpdateDomainKeepsLinks(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		upsertTestDomains(t, store, primitive.NewObjectID(), "example.com")
+		domain := claimTestDomain(t, store, "example.com")
+
+		// Found again while it is being crawled
+		if _, err := store.AddLinks(ctx, map[string]Links{"example.com": {Count: 3, Sources: []string{SourceScript}}}); err != nil {
+			t.Fatal(err)
+		}
+		domain.Status = StatusOK
+		domain.Headers = []Header{{Key: "Server", Value: "nginx"}}
+		if err := store.UpdateDomain(ctx, "test", domain); err != nil {
+			t.Fatal(err)
+		}
+		saved := getTestDomain(t, store, "example.com")
+		if saved.InDegree != 4 || len(saved.DiscoverySources) != 2 {
+			t.Errorf("saving the crawl lost links: InDegree %d, sources %v", saved.InDegree, saved.DiscoverySources)
+		}
+		if saved.Status != StatusOK || len(saved.Headers) != 1 {
+			t.Errorf("crawl not saved: %+v", saved)
+		}
+
+		// Fields emptied by a later crawl are removed
+		domain = saved
+		domain.Status = StatusRetry
+		domain.Headers = nil
+		if err := store.UpdateDomain(ctx, "test", domain); err != nil {
+			t.Fatal(err)
+		}
+		if saved = getTestDomain(t, store, "example.com"); len(saved.Headers) != 0 || saved.Status != StatusRetry {
+			t.Errorf("Status %q and headers %v after saving a retry", saved.Status, saved.Headers)
+		}
+	})
+}
+
+func TestStoreClaimDomainsToRecrawl(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		upsertTestDomains(t, store, primitive.NilObjectID, "popular.example.com", "stale.example.com", "fresh.example.com", "ignored.example.com")
+		for i := 0; i < 2; i++ {
+			upsertTestDomains(t, store, primitive.NewObjectID(), "popular.example.com")
+		}
+		now := time.Now()
+		saveTestDomains(t, store, func(domain *Domain) {
+			domain.Status = StatusOK
+			domain.LastChecked = now.Add(-2 * time.Hour)
+			switch domain.Name {
+			case "popular.example.com":
+				domain.LastChecked = now.Add(-3 * time.Hour)
+			case "stale.example.com":
+				domain.LastChecked = now.Add(-72 * time.Hour)
+			case "ignored.example.com":
+				domain.LastChecked = now.Add(-72 * time.Hour)
+				domain.Status = StatusIgnored
+			}
+		})
+
+		policy := RecrawlPolicy{MaxAge: 48 * time.Hour, PopularMaxAge: time.Hour}
+		domains, err := store.ClaimDomainsToRecrawl(ctx, "first", 10, time.Minute, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := domainNames(domains); names != "stale.example.com" {
+			t.Errorf("recrawling without popular domains claimed %s", names)
+		}
+
+		// Popular domains use the shorter age, oldest crawls come first
+		upsertTestDomains(t, store, primitive.NewObjectID(), "fresh.example.com")
+		policy.PopularInDegree = 2
+		domains, err = store.ClaimDomainsToRecrawl(ctx, "second", 10, time.Minute, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := domainNames(domains); names != "popular.example.com" {
+			t.Errorf("recrawling popular domains claimed %s", names)
+		}
+
+		for _, domain := range domains {
+			domain.ClaimedBy = ""
+			domain.LeaseExpires = time.Time{}
+			if err = store.UpdateDomain(ctx, "second", domain); err != nil {
+				t.Fatal(err)
+			}
+		}
+		policy.MaxAge = time.Hour
+		domains, err = store.ClaimDomainsToRecrawl(ctx, "third", 10, time.Minute, policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := domainNames(domains); names != "popular.example.com,fresh.example.com" {
+			t.Errorf("recrawling everything older than an hour claimed %s", names)
+		}
+	})
+}
+
+func TestStoreCountByStatusLegacySkipped(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store DomainStore) {
+		upsertTestDomains(t, store, primitive.NilObjectID, "skipped.example.com", "legacy.example.com", "ok.example.com", "failed.example.com")
+		saveTestDomains(t, store, func(domain *Domain) {
+			domain.LastChecked = time.Now()
+			switch domain.Name {
+			case "skipped.example.com": // Written by a version from before Status
+				domain.Skipped = true
+			case "legacy.example.com":
+				domain.Headers = []Header{{Key: "Server", Value: "Apache"}}
+			case "ok.example.com":
+				domain.Status = StatusOK
+				domain.Headers = []Header{{Key: "Server", Value: "nginx"}}
+			case "failed.example.com":
+				domain.Status = StatusFailed
+				domain.ErrorClass = ErrorClassDNS
+			}
+		})
+		upsertTestDomains(t, store, primitive.NilObjectID, "new.example.com")
+
+		counts, err := store.CountByStatus(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make(map[string]int)
+		for _, count := range counts {
+			got[string(count.Status)+"/"+count.ErrorClass] += count.Count
+		}
+		want := map[string]int{
+			string(StatusSkipped) + "/":                1,
+			string(StatusOK) + "/":                     2,
+			string(StatusFailed) + "/" + ErrorClassDNS: 1,
+			string(StatusUnchecked) + "/":              1,
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("CountByStatus returned %v, want %v", got, want)
+		}
+		if !sort.SliceIsSorted(counts, func(i, j int) bool { return counts[i].Status < counts[j].Status }) {
+			t.Errorf("counts are not sorted by status: %+v", counts)
+		}
+
+		count, err := store.CountDomains(context.Background(), DomainFilter{Status: StatusSkipped})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("%d domains listed as skipped, want 1", count)
+		}
+	})
+}
+
+func TestStoreListObservations(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		upsertTestDomains(t, store, primitive.NilObjectID, "example.com", "other.example.com")
+		domain := getTestDomain(t, store, "example.com")
+		other := getTestDomain(t, store, "other.example.com")
+
+		start := time.Now().Truncate(time.Millisecond)
+		for i := 0; i < 3; i++ {
+			_, err := store.AddObservation(ctx, Observation{
+				DomainId: domain.Id,
+				Time:     start.Add(time.Duration(i) * time.Hour),
+				Headers:  []Header{{Key: "X-Crawl", Value: fmt.Sprint(i)}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := store.AddObservation(ctx, Observation{DomainId: other.Id, Time: start}); err != nil {
+			t.Fatal(err)
+		}
+
+		observations, err := store.ListObservations(ctx, domain.Id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(observations) != 3 {
+			t.Fatalf("listed %d observations, want 3", len(observations))
+		}
+		for i, observation := range observations {
+			want := start.Add(time.Duration(2-i) * time.Hour)
+			if !observation.Time.Equal(want) || observation.Headers[0].Value != fmt.Sprint(2-i) {
+				t.Errorf("observation %d is from %s, want the newest first", i, observation.Time)
+			}
+		}
+	})
+}
+
+func TestStoreReleaseSiteResetsIgnored(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		upsertTestDomains(t, store, primitive.NilObjectID, "a.example.com", "a.example.org")
+		saveTestDomains(t, store, func(domain *Domain) {
+			domain.LastChecked = time.Now()
+			domain.Status = StatusIgnored
+		})
+
+		if err := store.ReleaseSite(ctx, "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		domains, err := store.ClaimDomainsToCheck(ctx, "test", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if names := domainNames(domains); names != "a.example.com" {
+			t.Errorf("claimed %s after the release, want only a.example.com", names)
+		}
+		if other := getTestDomain(t, store, "a.example.org"); other.Status != StatusIgnored {
+			t.Errorf("domain of another site is %q, want ignored", other.Status)
+		}
+	})
+}
+
+func TestStoreTechnologyHeaderFallback(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store DomainStore) {
+		upsertTestDomains(t, store, primitive.NilObjectID, "fingerprinted.example.com", "other.example.com", "legacy.example.com")
+		saveTestDomains(t, store, func(domain *Domain) {
+			domain.Status = StatusOK
+			domain.Headers = []Header{{Key: "Server", Value: "nginx/1.18.0"}}
+			switch domain.Name {
+			case "fingerprinted.example.com":
+				domain.Technologies = []Technology{{Name: "Nginx"}}
+				domain.Fingerprints = "1"
+			case "other.example.com":
+				// The rules did not agree with the header, so it is not used
+				domain.Fingerprints = "1"
+			}
+		})
+
+		for _, test := range []struct {
+			filter DomainFilter
+			want   int
+		}{
+			{DomainFilter{Technology: "Nginx"}, 1},
+			{DomainFilter{Technology: "Nginx", HeaderFallback: "^nginx"}, 2},
+			{DomainFilter{Technology: "Nginx", HeaderFallback: "^nginx", Status: StatusOK}, 2},
+			{DomainFilter{Technology: "Nginx", HeaderFallback: "^apache"}, 1},
+		} {
+			count, err := store.CountDomains(context.Background(), test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != test.want {
+				t.Errorf("%+v matched %d domains, want %d", test.filter, count, test.want)
+			}
+		}
+	})
+}
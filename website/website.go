@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
 	"net/http"
@@ -8,37 +9,38 @@ import (
 	"time"
 
 	"github.com/DevDungeon/WebGenome/core"
+	"github.com/docopt/docopt-go"
 	"github.com/dustin/go-humanize"
 	"github.com/julienschmidt/httprouter"
 	"github.com/unrolled/render"
 	"github.com/urfave/negroni"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 var (
 	resultsPerPage int = 25
+	store          core.DomainStore
 )
 
-func getParentDomains(domain core.Domain, dbConn *mgo.Collection) []core.Domain {
+func getParentDomains(ctx context.Context, domain core.Domain) []core.Domain {
 	var parentDomains []core.Domain
-	var tempDomain core.Domain
-	var emptyId bson.ObjectId
 
 	// End condition for recursion
-	if domain.ParentDomain == emptyId {
+	if domain.ParentDomain.IsZero() {
 		return parentDomains // Empty
 	}
 
-	getParentQuery := bson.M{"_id": domain.ParentDomain}
-	dbConn.Find(getParentQuery).One(&tempDomain)
+	tempDomain, err := store.GetDomainById(ctx, domain.ParentDomain)
+	if err != nil {
+		return parentDomains
+	}
 
 	// Return this domain as the last parent or recurse deeper
-	if tempDomain.ParentDomain == emptyId {
+	if tempDomain.ParentDomain.IsZero() {
 		parentDomains = append(parentDomains, tempDomain)
 	} else {
 		parentDomains = append(parentDomains, tempDomain)
-		parentDomains = append(parentDomains, getParentDomains(tempDomain, dbConn)...)
+		parentDomains = append(parentDomains, getParentDomains(ctx, tempDomain)...)
 	}
 	return parentDomains
 }
@@ -47,209 +49,136 @@ func viewDomain(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	renderer := render.New(render.Options{
 		Layout: "layout",
 	})
-	var domain core.Domain
 	var parentDomains []core.Domain
 
-	query := bson.M{"_id": bson.ObjectIdHex(ps.ByName("id"))}
-
-	session, _ := mgo.Dial("localhost")
-	defer session.Close()
-	dbConn := session.DB("webgenome").C("domains")
-	dbConn.Find(query).One(&domain)
+	id, err := primitive.ObjectIDFromHex(ps.ByName("id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	domain, err := store.GetDomainById(r.Context(), id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
 
 	// Get all parents
-	parentDomains = getParentDomains(domain, dbConn)
+	parentDomains = getParentDomains(r.Context(), domain)
+
+	observations, err := store.ListObservations(r.Context(), domain.Id)
+	if err != nil {
+		fmt.Println("Error getting observations for " + domain.Name + ". " + err.Error())
+	}
 
 	vars := map[string]interface{}{
 		"title":         "View Domain",
 		"domain":        domain,
 		"parentDomains": parentDomains,
+		"observations":  observations,
 	}
 
 	renderer.HTML(w, http.StatusOK, "view_domain", vars)
 }
 
 //func (w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-//	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"", ""}}}}
+//	filter := core.DomainFilter{HeaderValuePattern: ""}
 //	renderDomainList(w, r, p, query, "")
 //}
 
-func drupal(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Drupal", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Drupal Sites")
-}
-
-func django(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^django_language", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Django Sites")
-}
-
-func zope(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^Zope/", "i"}}}}
-	renderDomainListFromQuery(w, r, p, query, "Zope Sites")
-}
-
-func php(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^PHP/", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "PHP Sites")
-}
-
-func java(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^JSESSIONID=", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Java Sites")
-}
-
-func aspdotnet(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^ASP.NET_SessionId=", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "ASP.NET Sites")
-}
-
-func python(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Python/", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Python Sites")
-}
-
-func ruby(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Ruby/", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Ruby Sites")
-}
-
-func apache(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^Apache", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Apache Sites")
-}
-
-func nginx(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^nginx", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Nginx Sites")
-}
-
-func iis(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^Microsoft-IIS", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "IIS Sites")
-}
-
-func tomcat(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"tomcat", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Tomcat Sites")
-}
-
-func webrick(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^WEBrick", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "WEBrick Sites")
-}
-
-func lighttpd(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^lighttpd", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Lighttpd Sites")
-}
-
-func ibmhttpserver(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"^IBM_HTTP_Server", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "IBM HTTP Server")
-}
-
-func apusic(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Apusic", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Apusic Sites")
-}
-
-func enhydra(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Enhydra", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Enhydra Sites")
-}
-
-func jetty(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Jetty", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Jetty Sites")
-}
-
-func unix(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"(Unix)", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Unix Sites")
-}
-
-func linux(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Linux", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Linux Sites")
-}
-
-func debian(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Debian", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Debian sites")
-}
-
-func fedora(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Fedora", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Fedora Sites")
-}
-
-func redhat(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Red Hat", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Red Hat Sites")
-}
-
-func centos(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"CentOS", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "CentOS Sites")
-}
-
-func ubuntu(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Ubuntu", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Ubuntu Sites")
-}
-
-func freebsd(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"FreeBSD", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "FreeBSD Sites")
-}
-
-func win32(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Win32", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Win32 Sites")
-}
-
-func win64(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Win64", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Win64 Sites")
-}
-
-func darwin(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Darwin", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Darwin Sites")
+// Listings of the domains using a technology. Domains crawled before
+// fingerprinting are matched by a header value instead.
+var technologyListings = []struct {
+	path       string
+	technology string // Name in the fingerprint rules
+	header     string // Header value pattern for domains without fingerprints
+	title      string
+}{
+	{"/drupal", "Drupal", "Drupal", "Drupal Sites"},
+	{"/django", "Django", "^django_language", "Django Sites"},
+	{"/zope", "Zope", "(?i)^Zope/", "Zope Sites"},
+	{"/php", "PHP", "^PHP/", "PHP Sites"},
+	{"/java", "Java", "^JSESSIONID=", "Java Sites"},
+	{"/aspdotnet", "ASP.NET", "^ASP.NET_SessionId=", "ASP.NET Sites"},
+	{"/python", "Python", "Python/", "Python Sites"},
+	{"/ruby", "Ruby", "Ruby/", "Ruby Sites"},
+	{"/apache", "Apache", "^Apache", "Apache Sites"},
+	{"/nginx", "Nginx", "^nginx", "Nginx Sites"},
+	{"/iis", "IIS", "^Microsoft-IIS", "IIS Sites"},
+	{"/tomcat", "Tomcat", "tomcat", "Tomcat Sites"},
+	{"/webrick", "WEBrick", "^WEBrick", "WEBrick Sites"},
+	{"/lighttpd", "Lighttpd", "^lighttpd", "Lighttpd Sites"},
+	{"/ibmhttpserver", "IBM HTTP Server", "^IBM_HTTP_Server", "IBM HTTP Server"},
+	{"/apusic", "Apusic", "Apusic", "Apusic Sites"},
+	{"/enhydra", "Enhydra", "Enhydra", "Enhydra Sites"},
+	{"/jetty", "Jetty", "Jetty", "Jetty Sites"},
+	{"/unix", "Unix", "(Unix)", "Unix Sites"},
+	{"/linux", "Linux", "Linux", "Linux Sites"},
+	{"/debian", "Debian", "Debian", "Debian sites"},
+	{"/fedora", "Fedora", "Fedora", "Fedora Sites"},
+	{"/redhat", "Red Hat", "Red Hat", "Red Hat Sites"},
+	{"/centos", "CentOS", "CentOS", "CentOS Sites"},
+	{"/ubuntu", "Ubuntu", "Ubuntu", "Ubuntu Sites"},
+	{"/freebsd", "FreeBSD", "FreeBSD", "FreeBSD Sites"},
+	{"/win32", "Windows Server", "Win32", "Windows Server Sites"},
+	{"/win64", "Windows Server", "Win64", "Windows Server Sites"},
+	{"/darwin", "Darwin", "Darwin", "Darwin Sites"},
+	{"/phusionpassenger", "Phusion Passenger", "Phusion_Passenger", "Phusion Passenger Sites"},
+	{"/openssl", "OpenSSL", "OpenSSL", "OpenSSL Sites"},
+	{"/webdav", "WebDAV", "DAV", "WebDAV Sites"},
+	{"/communique", "Communique", "Communique", "Communique Sites"},
+	{"/bigipserver", "BIG-IP", "BIGipServer", "BIGipServer Sites"},
+}
+
+func technologyListing(technology string, header string, title string) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		filter := core.DomainFilter{Technology: technology, HeaderFallback: header}
+		renderDomainListFromQuery(w, r, p, filter, title)
+	}
 }
 
-func phusionpassenger(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Phusion_Passenger", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Phusion Passenger Sites")
+func checked(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	filter := core.DomainFilter{CheckedOnly: true}
+	renderDomainListFromQuery(w, r, p, filter, "Checked Domains")
 }
 
-func openssl(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"OpenSSL", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "OpenSSL Sites")
+func status(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	filter := core.DomainFilter{
+		Status:     core.CrawlStatus(p.ByName("status")),
+		ErrorClass: r.URL.Query().Get("errorclass"),
+	}
+	title := "Status: " + p.ByName("status")
+	if filter.ErrorClass != "" {
+		title += " (" + filter.ErrorClass + ")"
+	}
+	renderDomainListFromQuery(w, r, p, filter, title)
 }
 
-func webdav(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"DAV", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "WebDAV Sites")
+// Every domain of a registrable domain, e.g. blogspot.com
+func site(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	filter := core.DomainFilter{RegistrableDomain: p.ByName("name")}
+	renderDomainListFromQuery(w, r, p, filter, "Site: "+p.ByName("name"))
 }
 
-func communique(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"Communique", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "Communique Sites")
+// Domains the crawler fingerprinted as using the technology. Domains crawled
+// before fingerprinting are only in the header based listings.
+func technology(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	filter := core.DomainFilter{Technology: p.ByName("name")}
+	renderDomainListFromQuery(w, r, p, filter, p.ByName("name")+" Sites")
 }
 
-func bigipserver(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"headers": bson.M{"$elemMatch": bson.M{"value": bson.RegEx{"BIGipServer", ""}}}}
-	renderDomainListFromQuery(w, r, p, query, "BIGipServer Sites")
+func gov(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	filter := core.DomainFilter{NamePattern: ".gov"}
+	renderDomainListFromQuery(w, r, p, filter, "Government Sites")
 }
 
-func gov(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	query := bson.M{"name": bson.RegEx{".gov", ""}}
-	renderDomainListFromQuery(w, r, p, query, "Government Sites")
+// Link to another page of a listing keeping the other query parameters
+func pageUrl(r *http.Request, pageNumber int) string {
+	query := r.URL.Query()
+	query.Set("page", strconv.Itoa(pageNumber))
+	return r.URL.Path + "?" + query.Encode()
 }
 
-func renderDomainListFromQuery(w http.ResponseWriter, r *http.Request, _ httprouter.Params, query bson.M, title string) {
+func renderDomainListFromQuery(w http.ResponseWriter, r *http.Request, _ httprouter.Params, filter core.DomainFilter, title string) {
 
 	var (
 		page         string
@@ -264,21 +193,25 @@ func renderDomainListFromQuery(w http.ResponseWriter, r *http.Request, _ httprou
 		pageNumber, _ = strconv.Atoi(page)
 	}
 
-	var domains []core.Domain
-	session, _ := mgo.Dial("localhost")
-	defer session.Close()
-	dbConn := session.DB("webgenome").C("domains")
-	dbConn.Find(query).Limit(resultsPerPage).Skip((pageNumber - 1) * resultsPerPage).All(&domains)
+	// Any listing can be narrowed down by response details
+	filter.StatusCode, _ = strconv.Atoi(r.URL.Query().Get("status"))
+	filter.Protocol = r.URL.Query().Get("protocol")
+	filter.TLSOnly = r.URL.Query().Get("tls") != ""
+
+	domains, err := store.ListDomains(r.Context(), filter, (pageNumber-1)*resultsPerPage, resultsPerPage)
+	if err != nil {
+		fmt.Println("Error listing domains. " + err.Error())
+	}
 
 	if pageNumber <= 1 {
 		previousPage = ""
 	} else {
-		previousPage = r.URL.Path + "?page=" + strconv.Itoa(pageNumber-1)
+		previousPage = pageUrl(r, pageNumber-1)
 	}
 	if len(domains) < resultsPerPage {
 		nextPage = ""
 	} else {
-		nextPage = r.URL.Path + "?page=" + strconv.Itoa(pageNumber+1)
+		nextPage = pageUrl(r, pageNumber+1)
 	}
 
 	vars := map[string]interface{}{
@@ -287,6 +220,7 @@ func renderDomainListFromQuery(w http.ResponseWriter, r *http.Request, _ httprou
 		"pageNumber":   pageNumber,
 		"previousPage": previousPage,
 		"nextPage":     nextPage,
+		"filter":       filter,
 	}
 	renderer := render.New(render.Options{
 		Layout: "layout",
@@ -295,10 +229,7 @@ func renderDomainListFromQuery(w http.ResponseWriter, r *http.Request, _ httprou
 }
 
 func index(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	session, _ := mgo.Dial("localhost")
-	defer session.Close()
-	dbConn := session.DB("webgenome").C("domains")
-	totalDomains, err := dbConn.Count()
+	totalDomains, err := store.CountDomains(r.Context(), core.DomainFilter{})
 	if err != nil {
 		fmt.Println("Error getting total domain count." + err.Error())
 	}
@@ -314,26 +245,59 @@ func index(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	renderer.HTML(w, http.StatusOK, "index", vars)
 }
 
-func random(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
-	session, _ := mgo.Dial("localhost")
-	defer session.Close()
-	dbConn := session.DB("webgenome").C("domains")
-	totalDomains, err := dbConn.Count()
+func stats(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	statusCounts, err := store.CountByStatus(r.Context())
 	if err != nil {
-		fmt.Println("Error getting total domain count." + err.Error())
+		fmt.Println("Error counting domains by status. " + err.Error())
 	}
 
-	query := bson.M{"headers": bson.M{"$exists": true}}
-	var domain core.Domain
-	numDomainsToSkip := rand.Intn(totalDomains) % 1000000 // Hard limit of 5 mill for speed
-	err = dbConn.Find(query).Limit(1).Skip(numDomainsToSkip).One(&domain)
+	vars := map[string]interface{}{
+		"title":        "Crawl Statistics",
+		"statusCounts": statusCounts,
+	}
+
+	renderer := render.New(render.Options{
+		Layout: "layout",
+	})
+	renderer.HTML(w, http.StatusOK, "stats", vars)
+}
+
+// Sites the worker stopped crawling because they have too many subdomains
+func quarantine(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	sites, err := store.ListQuarantinedSites(r.Context())
 	if err != nil {
+		fmt.Println("Error listing quarantined sites. " + err.Error())
+	}
+
+	vars := map[string]interface{}{
+		"title": "Quarantined Sites",
+		"sites": sites,
+	}
+
+	renderer := render.New(render.Options{
+		Layout: "layout",
+	})
+	renderer.HTML(w, http.StatusOK, "quarantine", vars)
+}
+
+func random(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	totalDomains, err := store.CountDomains(r.Context(), core.DomainFilter{})
+	if err != nil || totalDomains == 0 {
+		fmt.Println("Error getting total domain count.")
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+
+	filter := core.DomainFilter{CheckedOnly: true}
+	numDomainsToSkip := rand.Intn(totalDomains) % 1000000 // Hard limit of 5 mill for speed
+	domains, err := store.ListDomains(r.Context(), filter, numDomainsToSkip, 1)
+	if err != nil || len(domains) == 0 {
 		fmt.Println("Random lookup went too far. Redirecting back to random.")
 		http.Redirect(w, r, "/random", http.StatusFound)
 		return
 	}
 
-	http.Redirect(w, r, "/domain/"+domain.Id.Hex(), http.StatusFound)
+	http.Redirect(w, r, "/domain/"+domains[0].Id.Hex(), http.StatusFound)
 	return
 }
 
@@ -341,18 +305,13 @@ func search(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 	var (
 		pageNumber int
 		nextPage   string
-		domains    []core.Domain
 	)
-	session, _ := mgo.Dial("localhost")
-	defer session.Close()
-	dbConn := session.DB("webgenome").C("domains")
 
 	domainKeyword := r.PostFormValue("domain-keyword")
 	fmt.Println("Search query: " + domainKeyword)
-	query := bson.M{"name": bson.RegEx{domainKeyword, "i"}}
-
-	err := dbConn.Find(query).All(&domains)
+	filter := core.DomainFilter{NamePattern: "(?i)" + domainKeyword}
 
+	domains, err := store.ListDomains(r.Context(), filter, 0, resultsPerPage)
 	if err != nil {
 		fmt.Println("Error with search.")
 		http.Redirect(w, r, "/", http.StatusFound)
@@ -361,8 +320,6 @@ func search(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 
 	pageNumber = 1
 
-	dbConn.Find(query).Limit(resultsPerPage).All(&domains)
-
 	if len(domains) < resultsPerPage {
 		nextPage = ""
 	} else {
@@ -400,8 +357,45 @@ func premium(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
 }
 
 func main() {
+	usage := `website - Web Genome website.
+
+Usage:
+  website [--store=<backend>] [--host=<host>] [--database=<dbname>] [--collection=<collectionname>] [--db-file=<path>] [--worker=<url>]
+  website -h | --help
+
+Options:
+  -h --help                   Show this screen.
+  --store=<backend>           Storage backend, mongo, bolt or worker [default: mongo].
+  --host=<host>               MongoDB host [default: localhost].
+  --database=<database>       MongoDB database name [default: webgenome].
+  --collection=<collection>   MongoDB collection name [default: domains].
+  --db-file=<path>            BoltDB file used by the bolt backend [default: webgenome.db].
+  --worker=<url>              Worker started with --serve, used by the worker backend [default: http://localhost:3001].`
+
+	arguments, err := docopt.Parse(usage, nil, true, "Web Genome Website", false)
+	if err != nil {
+		fmt.Println("Error parsing command line arguments. " + err.Error())
+		return
+	}
+
 	staticFilesDir := "./static/"
 
+	// The website never writes so the bolt file is opened read only
+	store, err = core.OpenDomainStore(context.Background(), core.StoreOptions{
+		Backend:    arguments["--store"].(string),
+		Host:       arguments["--host"].(string),
+		Database:   arguments["--database"].(string),
+		Collection: arguments["--collection"].(string),
+		File:       arguments["--db-file"].(string),
+		URL:        arguments["--worker"].(string),
+		ReadOnly:   true,
+	})
+	if err != nil {
+		fmt.Println("Error connecting to database. " + err.Error())
+		return
+	}
+	defer store.Close()
+
 	// Routing
 	router := httprouter.New()
 	router.GET("/", index)
@@ -409,42 +403,17 @@ func main() {
 	router.GET("/domain/:id", viewDomain)
 	router.GET("/random", random)
 	router.GET("/premium", premium)
+	router.GET("/stats", stats)
+	router.GET("/status/:status", status)
+	router.GET("/site/:name", site)
+	router.GET("/technology/:name", technology)
+	router.GET("/admin/quarantine", quarantine)
 
+	router.GET("/checked", checked)
 	router.GET("/gov", gov)
-	router.GET("/drupal", drupal)
-	router.GET("/django", django)
-	router.GET("/zope", zope)
-	router.GET("/php", php)
-	router.GET("/java", java)
-	router.GET("/aspdotnet", aspdotnet)
-	router.GET("/python", python)
-	router.GET("/ruby", ruby)
-	router.GET("/apache", apache)
-	router.GET("/nginx", nginx)
-	router.GET("/iis", iis)
-	router.GET("/tomcat", tomcat)
-	router.GET("/webrick", webrick)
-	router.GET("/lighttpd", lighttpd)
-	router.GET("/ibmhttpserver", ibmhttpserver)
-	router.GET("/apusic", apusic)
-	router.GET("/enhydra", enhydra)
-	router.GET("/jetty", jetty)
-	router.GET("/unix", unix)
-	router.GET("/linux", linux)
-	router.GET("/debian", debian)
-	router.GET("/fedora", fedora)
-	router.GET("/redhat", redhat)
-	router.GET("/centos", centos)
-	router.GET("/ubuntu", ubuntu)
-	router.GET("/freebsd", freebsd)
-	router.GET("/win32", win32)
-	router.GET("/win64", win64)
-	router.GET("/darwin", darwin)
-	router.GET("/phusionpassenger", phusionpassenger)
-	router.GET("/openssl", openssl)
-	router.GET("/webdav", webdav)
-	router.GET("/communique", communique)
-	router.GET("/bigipserver", bigipserver)
+	for _, listing := range technologyListings {
+		router.GET(listing.path, technologyListing(listing.technology, listing.header, listing.title))
+	}
 
 	// Unchecked sites
 	// Checked sites
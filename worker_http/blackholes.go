@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+
+	"github.com/DevDungeon/WebGenome/core"
+)
+
+// Sites like blogspot.com have an almost infinite number of subdomains. Once
+// a site has more than maxSubdomains it is quarantined: its subdomains are
+// no longer added or crawled until it is released.
+type blackHoles struct {
+	store         core.DomainStore
+	maxSubdomains int
+
+	mutex       sync.RWMutex
+	quarantined map[string]bool
+}
+
+// Load the sites quarantined so far, also by other workers
+func (holes *blackHoles) refresh(ctx context.Context) error {
+	sites, err := holes.store.ListQuarantinedSites(ctx)
+	if err != nil {
+		return err
+	}
+	quarantined := make(map[string]bool, len(sites))
+	for _, site := range sites {
+		quarantined[site.Name] = true
+	}
+	holes.mutex.Lock()
+	holes.quarantined = quarantined
+	holes.mutex.Unlock()
+	return nil
+}
+
+// Whether the domain is a subdomain of a quarantined site. The registrable
+// domain itself is always crawled.
+func (holes *blackHoles) contains(domainName string) bool {
+	site := siteOf(domainName)
+	if site == domainName {
+		return false
+	}
+	holes.mutex.RLock()
+	defer holes.mutex.RUnlock()
+	return holes.quarantined[site]
+}
+
+// Count a newly added domain against its site
+func (holes *blackHoles) addSubdomain(ctx context.Context, domainName string) {
+	site := siteOf(domainName)
+	if site == domainName || holes.maxSubdomains <= 0 {
+		return
+	}
+	counts, err := holes.store.AddSubdomain(ctx, site, holes.maxSubdomains)
+	if err != nil {
+		logError("Error counting subdomains of: " + site + ". " + err.Error())
+		return
+	}
+	if !counts.Quarantined {
+		return
+	}
+	holes.mutex.Lock()
+	defer holes.mutex.Unlock()
+	if !holes.quarantined[site] {
+		logError("Quarantined " + site + " after " + strconv.Itoa(counts.Subdomains) + " subdomains.")
+		holes.quarantined[site] = true
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+)
+
+// How often the Bloom filter is written to its snapshot file
+const bloomSnapshotInterval = 10 * time.Minute
+
+// Start of a snapshot file, followed by the size, hash count, entry count,
+// the store's domain count, the store's identity and the bits
+var bloomMagic = [8]byte{'W', 'G', 'B', 'L', 'O', 'O', 'M', '2'}
+
+var (
+	errBloomSnapshotMismatch = errors.New("snapshot was made with a different capacity or false positive rate")
+	errBloomSnapshotStale    = errors.New("snapshot was made of a different store or the store has changed since")
+)
+
+type bloomSnapshotHeader struct {
+	Magic          [8]byte
+	Size           uint64
+	Hashes         uint64
+	Count          uint64
+	Domains        uint64 // In the store when the snapshot was made
+	IdentityLength uint32
+}
+
+// Approximate set of the domain names in the store. A name that was added is
+// always found; a name that was not is found with the false positive rate the
+// filter was sized for, as long as no more than its capacity were added.
+type bloomFilter struct {
+	size   uint64 // Bits
+	hashes uint64
+
+	// Store the names come from, set by open. Snapshots record its identity
+	// and domain count so a snapshot of another store is not used.
+	store         core.DomainStore
+	storeIdentity string
+
+	mutex sync.RWMutex
+	bits  []uint64
+	count uint64 // Names added, including duplicates
+}
+
+// Size a filter for capacity names at the given false positive rate
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	size := uint64(math.Ceil(-float64(capacity) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	if size < 64 {
+		size = 64
+	}
+	hashes := uint64(math.Round(float64(size) / float64(capacity) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	}
+	return &bloomFilter{size: size, hashes: hashes, bits: make([]uint64, (size+63)/64)}
+}
+
+// Two independent hashes of the name, combined into as many as needed
+func bloomHashes(name string) (uint64, uint64) {
+	hash := fnv.New128a()
+	hash.Write([]byte(name))
+	sum := hash.Sum(nil)
+	return binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:]) | 1
+}
+
+func (filter *bloomFilter) add(name string) {
+	h1, h2 := bloomHashes(name)
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	for i := uint64(0); i < filter.hashes; i++ {
+		bit := (h1 + i*h2) % filter.size
+		filter.bits[bit/64] |= 1 << (bit % 64)
+	}
+	filter.count++
+}
+
+// Whether the name was probably added
+func (filter *bloomFilter) contains(name string) bool {
+	h1, h2 := bloomHashes(name)
+	filter.mutex.RLock()
+	defer filter.mutex.RUnlock()
+	for i := uint64(0); i < filter.hashes; i++ {
+		bit := (h1 + i*h2) % filter.size
+		if filter.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (filter *bloomFilter) memoryUsage() int {
+	return len(filter.bits) * 8
+}
+
+// False positive rate given the share of bits set so far
+func (filter *bloomFilter) estimatedFalsePositiveRate() float64 {
+	filter.mutex.RLock()
+	defer filter.mutex.RUnlock()
+	set := 0
+	for _, word := range filter.bits {
+		set += bits.OnesCount64(word)
+	}
+	return math.Pow(float64(set)/float64(filter.size), float64(filter.hashes))
+}
+
+func (filter *bloomFilter) log() {
+	filter.mutex.RLock()
+	count := filter.count
+	filter.mutex.RUnlock()
+	logGreen("Bloom filter: " + strconv.FormatFloat(float64(filter.memoryUsage())/(1024*1024), 'f', 1, 64) + " MiB, " +
+		strconv.FormatUint(filter.hashes, 10) + " hashes, " + strconv.FormatUint(count, 10) + " names, " +
+		strconv.FormatFloat(filter.estimatedFalsePositiveRate()*100, 'f', 4, 64) + "% false positives")
+}
+
+// Add the name of every domain in the store
+func (filter *bloomFilter) warm(ctx context.Context) error {
+	return filter.store.ForEachDomainName(ctx, func(name string) error {
+		filter.add(name)
+		return nil
+	})
+}
+
+// Number of domains in the store, recorded in snapshots
+func (filter *bloomFilter) storeDomains(ctx context.Context) (uint64, error) {
+	count, err := filter.store.CountDomains(ctx, core.DomainFilter{})
+	return uint64(count), err
+}
+
+// Replace the contents of the filter with a snapshot made by save. The
+// snapshot has to be of a filter of the same size, made of the same store
+// while it had as many domains as it has now.
+func (filter *bloomFilter) load(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+
+	var header bloomSnapshotHeader
+	if err = binary.Read(reader, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if header.Magic != bloomMagic {
+		return errors.New(path + " is not a Bloom filter snapshot")
+	}
+	if header.Size != filter.size || header.Hashes != filter.hashes {
+		return errBloomSnapshotMismatch
+	}
+	identity := make([]byte, header.IdentityLength)
+	if _, err = io.ReadFull(reader, identity); err != nil {
+		return err
+	}
+	domains, err := filter.storeDomains(ctx)
+	if err != nil {
+		return err
+	}
+	if string(identity) != filter.storeIdentity || header.Domains != domains {
+		return errBloomSnapshotStale
+	}
+	words := make([]uint64, len(filter.bits))
+	if err = binary.Read(reader, binary.BigEndian, words); err != nil {
+		return err
+	}
+
+	filter.mutex.Lock()
+	defer filter.mutex.Unlock()
+	filter.bits = words
+	filter.count = header.Count
+	return nil
+}
+
+// Write the filter to path, replacing the previous snapshot only once the
+// new one is complete
+func (filter *bloomFilter) save(ctx context.Context, path string) error {
+	domains, err := filter.storeDomains(ctx)
+	if err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), ".bloom-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if err = filter.write(file, domains); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (filter *bloomFilter) write(writer io.Writer, domains uint64) error {
+	buffered := bufio.NewWriter(writer)
+	filter.mutex.RLock()
+	defer filter.mutex.RUnlock()
+	header := bloomSnapshotHeader{
+		Magic:          bloomMagic,
+		Size:           filter.size,
+		Hashes:         filter.hashes,
+		Count:          filter.count,
+		Domains:        domains,
+		IdentityLength: uint32(len(filter.storeIdentity)),
+	}
+	for _, value := range []interface{}{header, []byte(filter.storeIdentity), filter.bits} {
+		if err := binary.Write(buffered, binary.BigEndian, value); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// Fill the filter from the snapshot if there is a usable one, otherwise from
+// the store. The identity names the store in snapshots.
+func (filter *bloomFilter) open(ctx context.Context, store core.DomainStore, identity string, snapshot string) error {
+	filter.store = store
+	filter.storeIdentity = identity
+	if snapshot != "" {
+		err := filter.load(ctx, snapshot)
+		if err == nil {
+			logGreen("Loaded Bloom filter from " + snapshot)
+			return nil
+		}
+		if !os.IsNotExist(err) {
+			logError("Not using Bloom filter snapshot " + snapshot + ". " + err.Error())
+		}
+	}
+	logGreen("Loading domain names from the database into the Bloom filter.")
+	return filter.warm(ctx)
+}
+
+// Save the filter every bloomSnapshotInterval until ctx is done
+func (filter *bloomFilter) snapshotPeriodically(ctx context.Context, path string) {
+	ticker := time.NewTicker(bloomSnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := filter.save(ctx, path); err != nil {
+				logError("Error saving Bloom filter snapshot. " + err.Error())
+			}
+		}
+	}
+}
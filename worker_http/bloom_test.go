@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/DevDungeon/WebGenome/core"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestBloomSnapshotOfOtherStoreIsNotUsed(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := core.NewBoltStore(filepath.Join(dir, "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err = store.UpsertDiscoveredDomains(ctx, []core.Discovery{{Name: "example.com"}}, primitive.NilObjectID); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := filepath.Join(dir, "bloom")
+
+	filter := newBloomFilter(100, 0.001)
+	if err = filter.open(ctx, store, "bolt://test.db", snapshot); err != nil {
+		t.Fatal(err)
+	}
+	filter.add("saved.example.org")
+	if err = filter.save(ctx, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newBloomFilter(100, 0.001)
+	if err = loaded.open(ctx, store, "bolt://test.db", snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.contains("saved.example.org") {
+		t.Error("snapshot of the same store was not loaded")
+	}
+
+	for _, test := range []struct{ name, identity string }{{"other store", "bolt://other.db"}, {"changed store", "bolt://test.db"}} {
+		name := test.name
+		if name == "changed store" {
+			if _, err = store.UpsertDiscoveredDomains(ctx, []core.Discovery{{Name: "example.net"}}, primitive.NilObjectID); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rebuilt := newBloomFilter(100, 0.001)
+		if err = rebuilt.open(ctx, store, test.identity, snapshot); err != nil {
+			t.Fatal(err)
+		}
+		if rebuilt.contains("saved.example.org") || !rebuilt.contains("example.com") {
+			t.Errorf("%s: filter was not rebuilt from the store", name)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Contents of the file given with --config. Everything is optional; settings
+// missing from the file keep their command line values.
+type crawlConfig struct {
+	UserAgent   string `yaml:"user_agent"`
+	HTTPTimeout int    `yaml:"http_timeout"` // Seconds
+	Scheme      string `yaml:"scheme"`
+
+	// Domains that are never added or crawled
+	Exclude struct {
+		Hosts    []string `yaml:"hosts"`    // Exact names
+		Suffixes []string `yaml:"suffixes"` // .blogspot.com for its subdomains, blogspot.com to include itself
+		Globs    []string `yaml:"globs"`    // e.g. ads.*.example.com
+		Regexes  []string `yaml:"regexes"`
+		CIDRs    []string `yaml:"cidrs"` // Compared with the resolved address
+	} `yaml:"exclude"`
+
+	TLDs struct {
+		Allow []string `yaml:"allow"` // Only crawl these top level domains when set
+		Deny  []string `yaml:"deny"`
+	} `yaml:"tlds"`
+}
+
+// Compiled form of the scope rules in crawlConfig
+type crawlScope struct {
+	hosts     map[string]bool
+	suffixes  []string
+	globs     []string
+	regexes   []*regexp.Regexp
+	cidrs     []*net.IPNet
+	allowTLDs map[string]bool
+	denyTLDs  map[string]bool
+}
+
+func lowerSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[strings.ToLower(strings.Trim(value, "."))] = true
+	}
+	return set
+}
+
+func newCrawlScope(config crawlConfig) (*crawlScope, error) {
+	scope := &crawlScope{
+		hosts:     lowerSet(config.Exclude.Hosts),
+		allowTLDs: lowerSet(config.TLDs.Allow),
+		denyTLDs:  lowerSet(config.TLDs.Deny),
+	}
+	for _, suffix := range config.Exclude.Suffixes {
+		scope.suffixes = append(scope.suffixes, strings.ToLower(strings.TrimSuffix(suffix, ".")))
+	}
+	for _, glob := range config.Exclude.Globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("bad glob %q: %v", glob, err)
+		}
+		scope.globs = append(scope.globs, strings.ToLower(glob))
+	}
+	for _, pattern := range config.Exclude.Regexes {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		scope.regexes = append(scope.regexes, regex)
+	}
+	for _, cidr := range config.Exclude.CIDRs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		scope.cidrs = append(scope.cidrs, network)
+	}
+	return scope, nil
+}
+
+// Why the domain is out of scope, or an empty string if it is in scope
+func (scope *crawlScope) excludes(domainName string) string {
+	tld := domainName[strings.LastIndex(domainName, ".")+1:]
+	switch {
+	case len(scope.allowTLDs) > 0 && !scope.allowTLDs[tld]:
+		return "top level domain not allowed"
+	case scope.denyTLDs[tld]:
+		return "top level domain denied"
+	case scope.hosts[domainName]:
+		return "excluded host"
+	}
+	for _, suffix := range scope.suffixes {
+		if matchesSuffix(domainName, suffix) {
+			return "excluded suffix " + suffix
+		}
+	}
+	for _, glob := range scope.globs {
+		if matched, _ := path.Match(glob, domainName); matched {
+			return "excluded glob " + glob
+		}
+	}
+	for _, regex := range scope.regexes {
+		if regex.MatchString(domainName) {
+			return "excluded pattern " + regex.String()
+		}
+	}
+	return ""
+}
+
+// Suffixes match whole labels, so example.com excludes www.example.com but not
+// badexample.com. A leading dot leaves the name itself out.
+func matchesSuffix(domainName string, suffix string) bool {
+	if strings.HasPrefix(suffix, ".") {
+		return strings.HasSuffix(domainName, suffix)
+	}
+	return domainName == suffix || strings.HasSuffix(domainName, "."+suffix)
+}
+
+// Resolve the domain and check its addresses against the excluded networks.
+// Names that do not resolve are left for the crawl to fail on.
+func (scope *crawlScope) excludesAddress(ctx context.Context, domainName string) string {
+	if len(scope.cidrs) == 0 {
+		return ""
+	}
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, domainName)
+	if err != nil {
+		return ""
+	}
+	for _, address := range addresses {
+		for _, network := range scope.cidrs {
+			if network.Contains(address.IP) {
+				return "address " + address.IP.String() + " in excluded network " + network.String()
+			}
+		}
+	}
+	return ""
+}
+
+// The fetcher and scope currently in use. Both are replaced as a whole when
+// the config file is reloaded so running crawls are not affected.
+type crawlSettings struct {
+	configPath string
+	defaults   fetcher // From the command line
+
+	fetcher atomic.Pointer[fetcher]
+	scope   atomic.Pointer[crawlScope]
+}
+
+// Read the config file, if any, and apply it on top of the command line
+func (settings *crawlSettings) load() error {
+	var config crawlConfig
+	if settings.configPath != "" {
+		data, err := os.ReadFile(settings.configPath)
+		if err != nil {
+			return err
+		}
+		if err = yaml.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("%s: %v", settings.configPath, err)
+		}
+	}
+
+	scope, err := newCrawlScope(config)
+	if err != nil {
+		return fmt.Errorf("%s: %v", settings.configPath, err)
+	}
+	httpFetcher := settings.defaults
+	if config.UserAgent != "" {
+		httpFetcher.userAgent = config.UserAgent
+	}
+	if config.HTTPTimeout > 0 {
+		httpFetcher.httpTimeout = time.Duration(config.HTTPTimeout) * time.Second
+	}
+	if config.Scheme != "" {
+		if !validScheme(config.Scheme) {
+			return fmt.Errorf("%s: unknown scheme: %s", settings.configPath, config.Scheme)
+		}
+		httpFetcher.scheme = config.Scheme
+	}
+
+	settings.fetcher.Store(&httpFetcher)
+	settings.scope.Store(scope)
+	return nil
+}
+
+// Reload the config file whenever the process receives SIGHUP. A file with
+// errors is reported and the previous settings are kept.
+func (settings *crawlSettings) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	for range hangups {
+		if err := settings.load(); err != nil {
+			logError("Error reloading config, keeping previous settings. " + err.Error())
+			continue
+		}
+		logGreen("Reloaded config from " + settings.configPath)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCrawlScopeSuffixes(t *testing.T) {
+	var config crawlConfig
+	config.Exclude.Suffixes = []string{".blogspot.com", "Example.com."}
+	scope, err := newCrawlScope(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, excluded := range map[string]bool{
+		"a.blogspot.com":     true,
+		"blogspot.com":       false,
+		"notblogspot.com":    false,
+		"example.com":        true,
+		"www.example.com":    true,
+		"badexample.com":     false,
+		"example.com.evil":   false,
+		"www.badexample.com": false,
+	} {
+		if got := scope.excludes(name) != ""; got != excluded {
+			t.Errorf("excludes(%s) = %v, want %v", name, got, excluded)
+		}
+	}
+}
+
+func TestSettingsRejectUnknownScheme(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	settings := &crawlSettings{configPath: path, defaults: fetcher{scheme: schemeHTTP}}
+	if err := os.WriteFile(path, []byte("scheme: https-first\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.load(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("scheme: ftp\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := settings.load(); err == nil {
+		t.Error("config with scheme ftp was loaded")
+	}
+	if scheme := settings.fetcher.Load().scheme; scheme != schemeHTTPSFirst {
+		t.Errorf("scheme is %s after the rejected reload, want the previous https-first", scheme)
+	}
+}
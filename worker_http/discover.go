@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/DevDungeon/WebGenome/core"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Collects discovered domains keeping the first source each name was seen in
+type discoveries struct {
+	self  string // The domain being crawled is never added
+	found []core.Discovery
+	seen  map[string]bool
+}
+
+func newDiscoveries(self string) *discoveries {
+	return &discoveries{self: self, seen: make(map[string]bool)}
+}
+
+func (d *discoveries) add(name string, source string) {
+	d.addDiscovery(core.Discovery{Name: name, Source: source})
+}
+
+func (d *discoveries) addDiscovery(discovery core.Discovery) {
+	if discovery.Name == d.self || d.seen[discovery.Name] {
+		return
+	}
+	d.seen[discovery.Name] = true
+	d.found = append(d.found, discovery)
+}
+
+func (d *discoveries) addUrl(rawUrl string, base *url.URL, source string) {
+	host, port, found := hostFromUrl(rawUrl, base)
+	if found {
+		d.addDiscovery(core.Discovery{Name: host, Port: port, Source: source})
+	}
+}
+
+// Names of the domains found so far, for logging
+func (d *discoveries) names() []string {
+	names := make([]string, len(d.found))
+	for i, discovery := range d.found {
+		names[i] = discovery.Name
+	}
+	return names
+}
+
+// Browsers drop these anywhere in a URL attribute
+var urlWhitespace = strings.NewReplacer("\t", "", "\n", "", "\r", "")
+
+// Resolve a possibly relative or protocol relative URL against base and
+// return its host name and port if it is an http(s) URL pointing at a domain
+// name rather than an IP address. The port is zero when it is the default
+// for the scheme.
+func hostFromUrl(rawUrl string, base *url.URL) (string, int, bool) {
+	parsed, err := url.Parse(urlWhitespace.Replace(strings.TrimSpace(rawUrl)))
+	if err != nil {
+		return "", 0, false
+	}
+	if base != nil {
+		parsed = base.ResolveReference(parsed)
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return "", 0, false
+	}
+
+	port := 0
+	if rawPort := parsed.Port(); rawPort != "" {
+		port, err = strconv.Atoi(rawPort)
+		if err != nil || port < 1 || port > 65535 {
+			return "", 0, false
+		}
+		if parsed.Scheme == "http" && port == 80 || parsed.Scheme == "https" && port == 443 {
+			port = 0
+		}
+	}
+	// Hostname strips the brackets of IPv6 literals, which are then rejected
+	host, found := cleanHostName(parsed.Hostname())
+	return host, port, found
+}
+
+// Elements whose attribute holds a single URL, in the order they are
+// searched. Navigation comes first so a domain that is both linked to and
+// loaded from is recorded as linked.
+var bodyUrlAttributes = []struct {
+	selector  string
+	attribute string
+	source    string
+}{
+	{"a[href]", "href", core.SourceAnchor},
+	{"area[href]", "href", core.SourceAnchor},
+	{"form[action]", "action", core.SourceForm},
+	{"link[href]", "href", core.SourceLink},
+	{"script[src]", "src", core.SourceScript},
+	{"img[src]", "src", core.SourceImage},
+	{"iframe[src]", "src", core.SourceIframe},
+}
+
+// URLs of a srcset attribute, e.g. small.jpg 480w, //cdn.example.com/large.jpg 2x
+func srcsetUrls(srcset string) []string {
+	var urls []string
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) > 0 {
+			urls = append(urls, fields[0])
+		}
+	}
+	return urls
+}
+
+// Target of a meta refresh, e.g. 5; url='https://example.com/'
+func metaRefreshUrl(content string) (string, bool) {
+	pos := strings.Index(content, ";")
+	if pos == -1 {
+		pos = strings.Index(content, ",")
+	}
+	if pos == -1 {
+		return "", false
+	}
+	target := strings.TrimSpace(content[pos+1:])
+	if len(target) > 3 && strings.EqualFold(target[:3], "url") {
+		target = strings.TrimSpace(target[3:])
+		if !strings.HasPrefix(target, "=") {
+			return "", false
+		}
+		target = strings.TrimSpace(target[1:])
+	}
+	target = strings.Trim(target, `"'`)
+	return target, target != ""
+}
+
+// Every string in a JSON-LD document that looks like an absolute URL
+func jsonLDUrls(value interface{}, urls []string) []string {
+	switch value := value.(type) {
+	case string:
+		lower := strings.ToLower(value)
+		if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+			urls = append(urls, value)
+		}
+	case []interface{}:
+		for _, item := range value {
+			urls = jsonLDUrls(item, urls)
+		}
+	case map[string]interface{}:
+		for _, item := range value {
+			urls = jsonLDUrls(item, urls)
+		}
+	}
+	return urls
+}
+
+// Link targets and resources in an HTML document, resolved against the URL
+// it was served from or its <base href>
+func addBodyDomains(d *discoveries, body []byte, base *url.URL) error {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	// Only the first base element counts
+	if href, exists := doc.Find("base[href]").First().Attr("href"); exists {
+		d.addUrl(href, base, core.SourceBase)
+		if parsed, err := url.Parse(urlWhitespace.Replace(strings.TrimSpace(href))); err == nil {
+			if base != nil {
+				parsed = base.ResolveReference(parsed)
+			}
+			if parsed.Scheme == "http" || parsed.Scheme == "https" {
+				base = parsed
+			}
+		}
+	}
+
+	for _, element := range bodyUrlAttributes {
+		doc.Find(element.selector).Each(func(i int, s *goquery.Selection) {
+			value, _ := s.Attr(element.attribute)
+			d.addUrl(value, base, element.source)
+		})
+	}
+	doc.Find("meta[http-equiv][content]").Each(func(i int, s *goquery.Selection) {
+		if equiv, _ := s.Attr("http-equiv"); !strings.EqualFold(strings.TrimSpace(equiv), "refresh") {
+			return
+		}
+		content, _ := s.Attr("content")
+		if target, found := metaRefreshUrl(content); found {
+			d.addUrl(target, base, core.SourceMetaRefresh)
+		}
+	})
+	doc.Find("img[srcset], source[srcset]").Each(func(i int, s *goquery.Selection) {
+		srcset, _ := s.Attr("srcset")
+		for _, rawUrl := range srcsetUrls(srcset) {
+			d.addUrl(rawUrl, base, core.SourceSrcset)
+		}
+	})
+	doc.Find(`script[type="application/ld+json"]`).Each(func(i int, s *goquery.Selection) {
+		var value interface{}
+		if json.Unmarshal([]byte(s.Text()), &value) != nil {
+			return
+		}
+		for _, rawUrl := range jsonLDUrls(value, nil) {
+			d.addUrl(rawUrl, nil, core.SourceJSONLD)
+		}
+	})
+	return nil
+}
+
+// Normalized domain name from a host or wildcard certificate name
+func cleanHostName(host string) (string, bool) {
+	name, err := core.NormalizeDomainName(strings.TrimPrefix(host, "*."))
+	return name, err == nil
+}
+
+// Every value of a header, which may appear more than once
+func headerValues(headers []core.Header, key string) []string {
+	var values []string
+	for _, header := range headers {
+		if http.CanonicalHeaderKey(header.Key) == key {
+			values = append(values, header.AllValues()...)
+		}
+	}
+	return values
+}
+
+// Hosts allowed by a Content-Security-Policy, e.g.
+// default-src 'self' https://cdn.example.com *.example.org; img-src data:
+func addCSPDomains(d *discoveries, policy string) {
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, source := range fields[1:] {
+			if strings.HasPrefix(source, "'") || strings.HasSuffix(source, ":") {
+				continue // Keywords, nonces, hashes and bare schemes
+			}
+			if !strings.Contains(source, "://") {
+				source = "https://" + source
+			}
+			d.addUrl(source, nil, core.SourceCSP)
+		}
+	}
+}
+
+// Targets of a Link header, e.g. <https://cdn.example.com/app.css>; rel=preload
+func addLinkHeaderDomains(d *discoveries, value string, base *url.URL) {
+	for _, link := range strings.Split(value, ",") {
+		start := strings.Index(link, "<")
+		end := strings.Index(link, ">")
+		if start > -1 && end > start {
+			d.addUrl(link[start+1:end], base, core.SourceLinkHeader)
+		}
+	}
+}
+
+// Domains referenced by the headers of a response
+func addHeaderDomains(d *discoveries, headers []core.Header, base *url.URL) {
+	for _, location := range headerValues(headers, "Location") {
+		d.addUrl(location, base, core.SourceLocation)
+	}
+	for _, origin := range headerValues(headers, "Access-Control-Allow-Origin") {
+		d.addUrl(origin, nil, core.SourceCORS)
+	}
+	for _, link := range headerValues(headers, "Link") {
+		addLinkHeaderDomains(d, link, base)
+	}
+	for _, key := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+		for _, policy := range headerValues(headers, key) {
+			addCSPDomains(d, policy)
+		}
+	}
+}
+
+// Domains found anywhere in a fetch apart from the body: the redirect chain,
+// the final response headers and the certificate
+func discoverFromResult(domainName string, result fetchResult) *discoveries {
+	d := newDiscoveries(domainName)
+	for _, hop := range result.responseInfo.RedirectChain {
+		base, _ := url.Parse(hop.URL)
+		addHeaderDomains(d, hop.Headers, base)
+	}
+	finalUrl, _ := url.Parse(result.responseInfo.FinalURL)
+	addHeaderDomains(d, result.headers, finalUrl)
+	if result.responseInfo.TLSInfo != nil {
+		for _, name := range result.responseInfo.TLSInfo.SANs {
+			if host, found := cleanHostName(name); found {
+				d.add(host, core.SourceCertificate)
+			}
+		}
+	}
+	return d
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+)
+
+var (
+	errBadRequest       = errors.New("could not create request")
+	errTooManyRedirects = errors.New("stopped after " + strconv.Itoa(maxRedirects) + " redirects")
+)
+
+// Everything learned from requesting the root page of a domain
+type fetchResult struct {
+	responseInfo core.ResponseInfo
+	headers      []core.Header
+	body         []byte
+	remoteIP     string
+}
+
+// Settings shared by every request the worker makes
+type fetcher struct {
+	userAgent   string
+	httpTimeout time.Duration
+	scheme      string         // http, https or https-first
+	rootCAs     *x509.CertPool // Used to verify certificates, nil for the system roots
+}
+
+// Certificates are checked separately so sites with bad ones are still recorded
+func newTransport() *http.Transport {
+	return &http.Transport{
+		DisableKeepAlives: true,
+		ForceAttemptHTTP2: true,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+	}
+}
+
+// Which URLs are tried for a domain
+const (
+	schemeHTTP       = "http"
+	schemeHTTPS      = "https"
+	schemeHTTPSFirst = "https-first" // Fall back to http
+)
+
+func validScheme(scheme string) bool {
+	return scheme == schemeHTTP || scheme == schemeHTTPS || scheme == schemeHTTPSFirst
+}
+
+// URLs to try in order for a domain depending on the scheme setting
+func (f *fetcher) urlsForDomain(domainName string) []string {
+	switch f.scheme {
+	case schemeHTTPS:
+		return []string{"https://" + domainName + "/"}
+	case schemeHTTPSFirst:
+		return []string{"https://" + domainName + "/", "http://" + domainName + "/"}
+	}
+	return []string{"http://" + domainName + "/"}
+}
+
+// Try each URL for the domain until one answers. The result of the last
+// attempt is returned along with its error if none did.
+func (f *fetcher) fetchDomain(ctx context.Context, domainName string) (fetchResult, error) {
+	var (
+		result fetchResult
+		err    error
+	)
+	for _, url := range f.urlsForDomain(domainName) {
+		result, err = f.fetch(ctx, url, domainName)
+		if err == nil || ctx.Err() != nil {
+			break
+		}
+	}
+	return result, err
+}
+
+func (f *fetcher) fetch(ctx context.Context, url string, domainName string) (fetchResult, error) {
+	var result fetchResult
+
+	// Record every redirect instead of silently following it
+	var redirectChain []core.RedirectHop
+
+	client := &http.Client{
+		Transport: newTransport(),
+		Timeout:   f.httpTimeout,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			redirect := request.Response
+			redirectChain = append(redirectChain, core.RedirectHop{
+				URL:        via[len(via)-1].URL.String(),
+				StatusCode: redirect.StatusCode,
+				Location:   redirect.Header.Get("Location"),
+				Headers:    headersFromResponse(redirect.Header),
+			})
+			if len(via) >= maxRedirects {
+				return errTooManyRedirects
+			}
+			return nil
+		},
+	}
+	request, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return result, fmt.Errorf("%w: %v", errBadRequest, err)
+	}
+
+	// Remember which address answered so it can be stored with the observation
+	// and when the first byte of the final response came back
+	var firstByteTime time.Time
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			result.remoteIP, _, _ = net.SplitHostPort(info.Conn.RemoteAddr().String())
+		},
+		GotFirstResponseByte: func() {
+			firstByteTime = time.Now()
+		},
+	}
+	request = request.WithContext(httptrace.WithClientTrace(request.Context(), trace))
+
+	request.Header.Set("User-Agent", f.userAgent)
+	request.Close = true
+	request.Header.Set("Connection", "close") // Double check the connection is closed
+	requestStartTime := time.Now()
+	response, err := client.Do(request)
+	if response != nil {
+		defer response.Body.Close()
+	}
+	if err != nil {
+		result.responseInfo.RedirectChain = redirectChain
+		return result, err
+	}
+
+	result.body, err = io.ReadAll(io.LimitReader(response.Body, maxBodySize))
+	if err != nil {
+		logInfo("Error reading response from: " + domainName + ". " + err.Error())
+	}
+	result.responseInfo = core.ResponseInfo{
+		StatusCode:      response.StatusCode,
+		Protocol:        response.Proto,
+		TLS:             response.TLS != nil,
+		FinalURL:        response.Request.URL.String(),
+		TimeToFirstByte: firstByteTime.Sub(requestStartTime),
+		Duration:        time.Since(requestStartTime),
+		RedirectChain:   redirectChain,
+	}
+	if response.TLS != nil {
+		result.responseInfo.TLSInfo = tlsInfoFromState(response.TLS, response.Request.URL.Hostname(), f.rootCAs)
+	}
+	result.headers = headersFromResponse(response.Header)
+	return result, nil
+}
+
+// Describe the negotiated connection and the certificate the server sent
+func tlsInfoFromState(state *tls.ConnectionState, host string, rootCAs *x509.CertPool) *core.TLSInfo {
+	info := &core.TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+	}
+	if len(state.PeerCertificates) == 0 {
+		return info
+	}
+
+	certificate := state.PeerCertificates[0]
+	info.Subject = certificate.Subject.String()
+	info.Issuer = certificate.Issuer.String()
+	info.NotBefore = certificate.NotBefore
+	info.NotAfter = certificate.NotAfter
+	info.SANs = append(info.SANs, certificate.DNSNames...)
+	for _, ip := range certificate.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, intermediate := range state.PeerCertificates[1:] {
+		intermediates.AddCert(intermediate)
+	}
+	_, err := certificate.Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         rootCAs,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		info.VerifyError = err.Error()
+	} else {
+		info.Verified = true
+	}
+	return info
+}
+
+// Sort a fetch error into one of the core.ErrorClass values
+func classifyError(err error) string {
+	var (
+		dnsError         *net.DNSError
+		netError         net.Error
+		certError        *tls.CertificateVerificationError
+		recordError      tls.RecordHeaderError
+		unknownAuthority x509.UnknownAuthorityError
+	)
+	switch {
+	case errors.Is(err, errBadRequest):
+		return core.ErrorClassBadRequest
+	case errors.Is(err, errTooManyRedirects):
+		return core.ErrorClassTooManyRedirects
+	case errors.As(err, &dnsError):
+		return core.ErrorClassDNS
+	case errors.Is(err, syscall.EMFILE) || strings.Contains(err.Error(), "too many open files"):
+		return core.ErrorClassTooManyOpenFiles
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return core.ErrorClassConnectionRefused
+	case errors.Is(err, syscall.ECONNRESET) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return core.ErrorClassConnectionReset
+	case errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netError) && netError.Timeout():
+		return core.ErrorClassTimeout
+	case errors.As(err, &certError) || errors.As(err, &recordError) || errors.As(err, &unknownAuthority) ||
+		strings.Contains(err.Error(), "tls: "):
+		return core.ErrorClassTLS
+	}
+	return core.ErrorClassOther
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTLSTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "test")
+		w.Write([]byte("<html></html>"))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchTLSInfo(t *testing.T) {
+	server := newTLSTestServer(t)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(server.Certificate())
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	f := &fetcher{userAgent: "test", httpTimeout: 5 * time.Second, scheme: "https", rootCAs: rootCAs}
+	result, err := f.fetchDomain(context.Background(), host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := result.responseInfo.TLSInfo
+	if info == nil {
+		t.Fatal("no TLS info for an https response")
+	}
+	if info.Version != "TLS 1.3" {
+		t.Errorf("Version is %q, want TLS 1.3", info.Version)
+	}
+	knownSuite := false
+	for _, suite := range tls.CipherSuites() {
+		knownSuite = knownSuite || suite.Name == info.CipherSuite
+	}
+	if !knownSuite {
+		t.Errorf("CipherSuite %q is not a secure suite name", info.CipherSuite)
+	}
+	if info.ALPN != "h2" {
+		t.Errorf("ALPN is %q, want h2", info.ALPN)
+	}
+	if result.responseInfo.Protocol != "HTTP/2.0" {
+		t.Errorf("Protocol is %q, want HTTP/2.0", result.responseInfo.Protocol)
+	}
+	sans := strings.Join(info.SANs, ",")
+	for _, san := range []string{"example.com", "127.0.0.1"} {
+		if !strings.Contains(sans, san) {
+			t.Errorf("SANs %v do not include %s", info.SANs, san)
+		}
+	}
+	if !info.Verified || info.VerifyError != "" {
+		t.Errorf("certificate not verified against the server's pool: %q", info.VerifyError)
+	}
+
+	// Without the pool the system roots do not know the test certificate,
+	// but the response is still recorded
+	f.rootCAs = nil
+	result, err = f.fetchDomain(context.Background(), host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = result.responseInfo.TLSInfo
+	if info == nil || info.Verified || info.VerifyError == "" {
+		t.Errorf("expected a verify error without the pool, got %+v", info)
+	}
+}
+
+func TestFetchHTTPSFirstFallsBackToHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("plain"))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	f := &fetcher{userAgent: "test", httpTimeout: 5 * time.Second, scheme: "https-first"}
+	result, err := f.fetchDomain(context.Background(), host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.responseInfo.TLS || result.responseInfo.TLSInfo != nil {
+		t.Error("plain HTTP response recorded as TLS")
+	}
+	if result.responseInfo.FinalURL != "http://"+host+"/" {
+		t.Errorf("FinalURL is %s, want the http URL", result.responseInfo.FinalURL)
+	}
+	if string(result.body) != "plain" {
+		t.Errorf("body is %q", result.body)
+	}
+
+	// Only https is tried when the scheme says so
+	f.scheme = "https"
+	if _, err = f.fetchDomain(context.Background(), host); err == nil {
+		t.Error("https only fetch of a plain HTTP server succeeded")
+	}
+}
+
+func TestFetchRedirectChain(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/first", http.StatusMovedPermanently)
+	})
+	mux.HandleFunc("/first", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Hop", "first")
+		http.Redirect(w, r, "/final", http.StatusFound)
+	})
+	mux.HandleFunc("/final", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("done"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	f := &fetcher{userAgent: "test", httpTimeout: 5 * time.Second, scheme: "http"}
+	result, err := f.fetchDomain(context.Background(), host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := result.responseInfo.RedirectChain
+	if len(chain) != 2 {
+		t.Fatalf("redirect chain has %d hops, want 2: %+v", len(chain), chain)
+	}
+	if chain[0].URL != server.URL+"/" || chain[0].StatusCode != http.StatusMovedPermanently || chain[0].Location != "/first" {
+		t.Errorf("first hop is %+v", chain[0])
+	}
+	if chain[1].URL != server.URL+"/first" || chain[1].StatusCode != http.StatusFound || chain[1].Location != "/final" {
+		t.Errorf("second hop is %+v", chain[1])
+	}
+	hopHeader := false
+	for _, header := range chain[1].Headers {
+		hopHeader = hopHeader || header.Key == "X-Hop" && header.Value == "first"
+	}
+	if !hopHeader {
+		t.Errorf("second hop headers %+v do not include X-Hop", chain[1].Headers)
+	}
+	if result.responseInfo.FinalURL != server.URL+"/final" || result.responseInfo.StatusCode != http.StatusOK {
+		t.Errorf("final response is %s %d", result.responseInfo.FinalURL, result.responseInfo.StatusCode)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+const (
+	// How long to wait before claiming again when the store has nothing to
+	// claim but running crawls may still discover more
+	frontierIdleDelay = 2 * time.Second
+	// How often the crawl rate is logged
+	throughputInterval = 30 * time.Second
+)
+
+// Claims domains ahead of the workers and keeps the frontier queue of the
+// pool filled so one slow crawl never leaves the other threads idle
+type prefetcher struct {
+	batches *scheduler
+	holes   *blackHoles
+	leases  *leaseKeeper
+	polite  *politeness
+	pool    *workerPool
+}
+
+// Claim and queue domains until the pool is stopping or there is nothing
+// left to crawl. At most one batch waits here besides the one in the queue.
+func (p *prefetcher) run(ctx context.Context) error {
+	for p.pool.stopping.Err() == nil {
+		// Only an idle pool can not add any more domains to claim
+		idle := p.pool.active() == 0
+
+		if err := p.holes.refresh(ctx); err != nil {
+			return err
+		}
+		domains, err := p.batches.nextBatch(ctx)
+		if err != nil {
+			return err
+		}
+		p.leases.hold(domains)
+
+		if len(domains) == 0 {
+			if idle && p.polite.pendingUntil().IsZero() {
+				logError("No domains found to check. Exiting.")
+				return nil
+			}
+			delay := frontierIdleDelay
+			if idle {
+				logInfo("Waiting for deferred domains.")
+				delay = busyDeferDelay
+			}
+			select {
+			case <-p.pool.stopping.Done():
+			case <-time.After(delay):
+			}
+			continue
+		}
+
+		for x, domain := range domains {
+			if !p.pool.submit(domain) {
+				p.pool.release(domains[x:])
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Log how many domains per second were handled since the last report until
+// ctx is done
+func reportThroughput(ctx context.Context, pool *workerPool) {
+	ticker := time.NewTicker(throughputInterval)
+	defer ticker.Stop()
+	last := pool.summary.count()
+	lastTime := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			count := pool.summary.count()
+			rate := float64(count-last) / now.Sub(lastTime).Seconds()
+			logGreen("Throughput: " + strconv.FormatFloat(rate, 'f', 2, 64) + " domains/second, " +
+				strconv.Itoa(count) + " total, " + strconv.Itoa(pool.queued()) + " queued")
+			last, lastTime = count, now
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Identifies this worker in the leases it takes, unique per process
+func defaultWorkerId() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+// Keeps the leases on the domains claimed alive until they are saved
+type leaseKeeper struct {
+	store    core.DomainStore
+	workerId string
+	lease    time.Duration
+
+	mutex sync.Mutex
+	ids   map[primitive.ObjectID]bool
+}
+
+// Start renewing the leases of newly claimed domains
+func (keeper *leaseKeeper) hold(domains []core.Domain) {
+	keeper.mutex.Lock()
+	defer keeper.mutex.Unlock()
+	if keeper.ids == nil {
+		keeper.ids = make(map[primitive.ObjectID]bool)
+	}
+	for _, domain := range domains {
+		keeper.ids[domain.Id] = true
+	}
+}
+
+// Stop renewing the lease of a domain that was saved or handed back
+func (keeper *leaseKeeper) drop(id primitive.ObjectID) {
+	keeper.mutex.Lock()
+	defer keeper.mutex.Unlock()
+	delete(keeper.ids, id)
+}
+
+// Renew the held leases a few times per lease period until ctx is done.
+// Saved domains have already released their lease and are left untouched.
+func (keeper *leaseKeeper) heartbeat(ctx context.Context) {
+	ticker := time.NewTicker(keeper.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		keeper.mutex.Lock()
+		ids := make([]primitive.ObjectID, 0, len(keeper.ids))
+		for id := range keeper.ids {
+			ids = append(ids, id)
+		}
+		keeper.mutex.Unlock()
+		if err := keeper.store.RenewLeases(ctx, keeper.workerId, ids, keeper.lease); err != nil {
+			logError("Error renewing leases. " + err.Error())
+		}
+	}
+}
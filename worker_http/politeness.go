@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+)
+
+// How long to put off a domain when its site or address already has as many
+// crawls running as allowed
+const busyDeferDelay = 10 * time.Second
+
+// Limits for crawls sharing a site or an address. Zero values disable a limit.
+type hostLimit struct {
+	maxConcurrent int
+	interval      time.Duration // Between the starts of two crawls
+}
+
+func newHostLimit(maxConcurrent int, perSecond float64) hostLimit {
+	limit := hostLimit{maxConcurrent: maxConcurrent}
+	if perSecond > 0 {
+		limit.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return limit
+}
+
+type hostState struct {
+	active        int
+	nextStart     time.Time // Earliest start of the next crawl
+	deferredUntil time.Time // Latest time a deferred crawl was told to come back
+}
+
+// Tracks the crawls running against each registrable domain and IP address
+// so a batch full of subdomains of one site does not hammer it
+type politeness struct {
+	site hostLimit
+	ip   hostLimit
+
+	mutex  sync.Mutex
+	sites  map[string]*hostState
+	ips    map[string]*hostState
+	latest time.Time // Latest time any deferred crawl comes back
+}
+
+func newPoliteness(site hostLimit, ip hostLimit) *politeness {
+	return &politeness{
+		site:  site,
+		ip:    ip,
+		sites: make(map[string]*hostState),
+		ips:   make(map[string]*hostState),
+	}
+}
+
+// Registrable domain according to the public suffix list, e.g.
+// www.example.co.uk -> example.co.uk
+func siteOf(domainName string) string {
+	site, err := core.RegistrableDomain(domainName)
+	if err != nil {
+		return domainName
+	}
+	return site
+}
+
+// Start a crawl of key if the limit allows it, otherwise return the time it
+// should be tried again. Deferred crawls are spread one interval apart.
+func (limit hostLimit) start(states map[string]*hostState, key string, now time.Time) (time.Time, bool) {
+	state := states[key]
+	if state == nil {
+		state = &hostState{}
+		states[key] = state
+	}
+
+	var retryAt time.Time
+	switch {
+	case limit.maxConcurrent > 0 && state.active >= limit.maxConcurrent:
+		retryAt = now.Add(busyDeferDelay)
+	case state.nextStart.After(now):
+		retryAt = state.nextStart
+	default:
+		state.active++
+		state.nextStart = now.Add(limit.interval)
+		return time.Time{}, true
+	}
+
+	if !state.deferredUntil.Before(retryAt) {
+		retryAt = state.deferredUntil.Add(limit.deferSpacing())
+	}
+	state.deferredUntil = retryAt
+	return retryAt, false
+}
+
+// Gap between two deferred crawls of one host. Without a rate limit it lets
+// as many crawls come back in busyDeferDelay as may run at once.
+func (limit hostLimit) deferSpacing() time.Duration {
+	if limit.interval > 0 || limit.maxConcurrent <= 0 {
+		return limit.interval
+	}
+	return busyDeferDelay / time.Duration(limit.maxConcurrent)
+}
+
+func (limit hostLimit) finish(states map[string]*hostState, key string) {
+	state := states[key]
+	if state == nil {
+		return
+	}
+	state.active--
+	// Forget idle hosts so the maps do not grow with every domain crawled
+	now := time.Now()
+	if state.active <= 0 && !state.nextStart.After(now) && !state.deferredUntil.After(now) {
+		delete(states, key)
+	}
+}
+
+func (p *politeness) deferred(retryAt time.Time) {
+	if retryAt.After(p.latest) {
+		p.latest = retryAt
+	}
+}
+
+// Try to start crawling the site. Call finishSite when done.
+func (p *politeness) startSite(site string) (time.Time, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	retryAt, started := p.site.start(p.sites, site, time.Now())
+	if !started {
+		p.deferred(retryAt)
+	}
+	return retryAt, started
+}
+
+func (p *politeness) finishSite(site string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.site.finish(p.sites, site)
+}
+
+// Resolve the domain and try to start crawling its address. The returned
+// address is empty when limits per address are off or the name does not
+// resolve, in which case the crawl may always start. Call finishIP when done.
+func (p *politeness) startIP(ctx context.Context, domainName string) (string, time.Time, bool) {
+	if p.ip == (hostLimit{}) {
+		return "", time.Time{}, true
+	}
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, domainName)
+	if err != nil || len(addresses) == 0 {
+		return "", time.Time{}, true
+	}
+	ip := addresses[0].IP.String()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	retryAt, started := p.ip.start(p.ips, ip, time.Now())
+	if !started {
+		p.deferred(retryAt)
+		return "", retryAt, false
+	}
+	return ip, time.Time{}, true
+}
+
+func (p *politeness) finishIP(ip string) {
+	if ip == "" {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.ip.finish(p.ips, ip)
+}
+
+// When the last deferred crawl is due, zero if none are waiting
+func (p *politeness) pendingUntil() time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.latest.Before(time.Now()) {
+		return time.Time{}
+	}
+	return p.latest
+}
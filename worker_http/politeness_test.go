@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHostLimitConcurrency(t *testing.T) {
+	limit := newHostLimit(2, 0)
+	states := make(map[string]*hostState)
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, started := limit.start(states, "example.com", now); !started {
+			t.Fatalf("crawl %d did not start", i+1)
+		}
+	}
+	retryAt, started := limit.start(states, "example.com", now)
+	if started || !retryAt.Equal(now.Add(busyDeferDelay)) {
+		t.Errorf("third crawl started %v, retry at +%s, want a deferral by %s", started, retryAt.Sub(now), busyDeferDelay)
+	}
+	if _, started = limit.start(states, "example.org", now); !started {
+		t.Error("crawl of another host did not start")
+	}
+
+	limit.finish(states, "example.com")
+	if _, started = limit.start(states, "example.com", now); !started {
+		t.Error("crawl did not start after another finished")
+	}
+}
+
+func TestHostLimitInterval(t *testing.T) {
+	limit := newHostLimit(0, 2)
+	if limit.interval != 500*time.Millisecond {
+		t.Fatalf("interval at 2 per second is %s", limit.interval)
+	}
+	states := make(map[string]*hostState)
+	now := time.Now()
+	if _, started := limit.start(states, "example.com", now); !started {
+		t.Fatal("first crawl did not start")
+	}
+	retryAt, started := limit.start(states, "example.com", now.Add(100*time.Millisecond))
+	if started || !retryAt.Equal(now.Add(limit.interval)) {
+		t.Errorf("crawl 100ms later started %v, retry at +%s, want +%s", started, retryAt.Sub(now), limit.interval)
+	}
+	if _, started = limit.start(states, "example.com", now.Add(limit.interval)); !started {
+		t.Error("crawl one interval later did not start")
+	}
+}
+
+func TestHostLimitDeferralsSpread(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   hostLimit
+		spacing time.Duration
+	}{
+		{"rate limited", newHostLimit(1, 1), time.Second},
+		{"threads only", newHostLimit(8, 0), busyDeferDelay / 8},
+		{"busy and rate limited", newHostLimit(2, 4), 250 * time.Millisecond},
+	}
+	for _, test := range tests {
+		states := make(map[string]*hostState)
+		now := time.Now()
+		for {
+			if _, started := test.limit.start(states, "example.com", now); !started {
+				break
+			}
+		}
+		var previous time.Time
+		for i := 0; i < 5; i++ {
+			retryAt, started := test.limit.start(states, "example.com", now)
+			if started {
+				t.Fatalf("%s: deferred crawl %d started", test.name, i+1)
+			}
+			if i > 0 && retryAt.Sub(previous) != test.spacing {
+				t.Errorf("%s: deferral %d is %s after the one before, want %s", test.name, i+1, retryAt.Sub(previous), test.spacing)
+			}
+			previous = retryAt
+		}
+	}
+}
+
+func TestHostLimitForgetsIdleHosts(t *testing.T) {
+	limit := newHostLimit(1, 1)
+	states := make(map[string]*hostState)
+	past := time.Now().Add(-time.Hour)
+
+	// Started long enough ago that the next crawl could start now
+	limit.start(states, "idle.example.com", past)
+	limit.finish(states, "idle.example.com")
+	if _, found := states["idle.example.com"]; found {
+		t.Error("idle host was kept")
+	}
+
+	// The interval since the start has not passed yet
+	limit.start(states, "recent.example.com", time.Now())
+	limit.finish(states, "recent.example.com")
+	if _, found := states["recent.example.com"]; !found {
+		t.Error("host was forgotten before its interval passed")
+	}
+
+	// A crawl was told to come back later
+	limit.start(states, "deferred.example.com", past)
+	limit.start(states, "deferred.example.com", time.Now())
+	limit.finish(states, "deferred.example.com")
+	if _, found := states["deferred.example.com"]; !found {
+		t.Error("host was forgotten while a crawl is deferred")
+	}
+
+	// Still running
+	limit = newHostLimit(2, 0)
+	limit.start(states, "busy.example.com", past)
+	limit.start(states, "busy.example.com", past)
+	limit.finish(states, "busy.example.com")
+	if _, found := states["busy.example.com"]; !found {
+		t.Error("host was forgotten while a crawl is running")
+	}
+
+	limit.finish(states, "unknown.example.com")
+	if _, found := states["unknown.example.com"]; found {
+		t.Error("finishing an unknown host added it")
+	}
+}
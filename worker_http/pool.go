@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+)
+
+// Outcomes of processDomain besides the status of the domain
+const (
+	outcomeDeferred = "deferred"   // Site or address busy, handed back for later
+	outcomeReleased = "released"   // Claimed but not crawled because of a shutdown
+	outcomeError    = "error"      // The result could not be saved
+	outcomeLost     = "lease-lost" // Taken over by another worker, result dropped
+)
+
+// Counts the outcomes of every domain handled, printed on exit
+type crawlSummary struct {
+	started time.Time
+
+	mutex    sync.Mutex
+	outcomes map[string]int
+	total    int
+}
+
+func newCrawlSummary() *crawlSummary {
+	return &crawlSummary{started: time.Now(), outcomes: make(map[string]int)}
+}
+
+func (summary *crawlSummary) record(outcome string) {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	summary.outcomes[outcome]++
+	summary.total++
+}
+
+func (summary *crawlSummary) count() int {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	return summary.total
+}
+
+func (summary *crawlSummary) log() {
+	summary.mutex.Lock()
+	defer summary.mutex.Unlock()
+	outcomes := make([]string, 0, len(summary.outcomes))
+	for outcome := range summary.outcomes {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+
+	elapsed := time.Since(summary.started)
+	logGreen("====== Summary ======")
+	logGreen("Domains:      " + strconv.Itoa(summary.total) + " in " + elapsed.Round(time.Second).String())
+	logGreen("Throughput:   " + strconv.FormatFloat(float64(summary.total)/elapsed.Seconds(), 'f', 2, 64) + " domains/second")
+	for _, outcome := range outcomes {
+		logGreen(fmt.Sprintf("%-14s%d", outcome+":", summary.outcomes[outcome]))
+	}
+	logGreen("=====================")
+}
+
+// A fixed number of goroutines crawling the domains queued for them
+type workerPool struct {
+	crawler  *crawler
+	leases   *leaseKeeper
+	jobs     chan core.Domain // The frontier of claimed domains
+	stopping context.Context  // Queued domains are released instead of crawled once done
+	stop     context.CancelFunc
+	summary  *crawlSummary
+
+	workers sync.WaitGroup
+	pending atomic.Int64 // Domains queued or being crawled
+
+	mutex sync.Mutex
+	err   error // First store error, which shuts the worker down
+}
+
+// Start threads workers crawling with ctx from a queue of queueSize domains.
+// stop is called when a worker hits an error it can not recover from.
+func newWorkerPool(ctx context.Context, stopping context.Context, stop context.CancelFunc, c *crawler, leases *leaseKeeper, threads int, queueSize int) *workerPool {
+	pool := &workerPool{
+		crawler:  c,
+		leases:   leases,
+		jobs:     make(chan core.Domain, queueSize),
+		stopping: stopping,
+		stop:     stop,
+		summary:  newCrawlSummary(),
+	}
+	for i := 0; i < threads; i++ {
+		pool.workers.Add(1)
+		go pool.work(ctx)
+	}
+	return pool
+}
+
+func (pool *workerPool) work(ctx context.Context) {
+	defer pool.workers.Done()
+	for domain := range pool.jobs {
+		if pool.stopping.Err() != nil {
+			pool.release([]core.Domain{domain})
+			pool.pending.Add(-1)
+			continue
+		}
+		logGreen("Checking " + domain.Name)
+		outcome, err := pool.crawler.processDomain(ctx, domain)
+		if errors.Is(err, core.ErrLeaseLost) {
+			logWarning("Lease on " + domain.Name + " was taken over by another worker. Dropping the result.")
+			outcome, err = outcomeLost, nil
+		}
+		if err != nil {
+			pool.fail(fmt.Errorf("saving %s: %v", domain.Name, err))
+			outcome = outcomeError
+		}
+		pool.leases.drop(domain.Id)
+		pool.summary.record(outcome)
+		pool.pending.Add(-1)
+	}
+}
+
+// Record the error and start shutting down
+func (pool *workerPool) fail(err error) {
+	logError("Fatal error: " + err.Error())
+	pool.mutex.Lock()
+	if pool.err == nil {
+		pool.err = err
+	}
+	pool.mutex.Unlock()
+	pool.stop()
+}
+
+func (pool *workerPool) failed() error {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	return pool.err
+}
+
+// Queue the domain for the next free worker, waiting while the queue is
+// full. Gives up and returns false once stopping is done.
+func (pool *workerPool) submit(domain core.Domain) bool {
+	if pool.stopping.Err() != nil {
+		return false
+	}
+	pool.pending.Add(1)
+	select {
+	case pool.jobs <- domain:
+		return true
+	case <-pool.stopping.Done():
+		pool.pending.Add(-1)
+		return false
+	}
+}
+
+// Hand claimed domains back without crawling them so other workers can have
+// them right away
+func (pool *workerPool) release(domains []core.Domain) {
+	for _, domain := range domains {
+		outcome := outcomeReleased
+		err := releaseDomain(context.Background(), pool.crawler.store, pool.crawler.workerId, domain)
+		if errors.Is(err, core.ErrLeaseLost) {
+			outcome, err = outcomeLost, nil
+		}
+		if err != nil {
+			logError("Error releasing " + domain.Name + ". " + err.Error())
+			continue
+		}
+		pool.leases.drop(domain.Id)
+		pool.summary.record(outcome)
+	}
+}
+
+// Number of domains queued or being crawled
+func (pool *workerPool) active() int {
+	return int(pool.pending.Load())
+}
+
+func (pool *workerPool) queued() int {
+	return len(pool.jobs)
+}
+
+// Let the workers finish the domains they have, release the queued ones and
+// exit
+func (pool *workerPool) close() {
+	close(pool.jobs)
+	pool.workers.Wait()
+}
+
+// The first SIGINT or SIGTERM stops claiming new domains and lets the running
+// crawls finish, the second one aborts them as well
+func handleShutdownSignals(stop context.CancelFunc, abort context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	logGreen("Shutting down once the running crawls finish. Interrupt again to abort them.")
+	stop()
+	<-signals
+	logError("Aborting the running crawls.")
+	abort()
+}
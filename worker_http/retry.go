@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+)
+
+// Longest wait between two attempts no matter how often a domain failed
+const maxRetryDelay = 7 * 24 * time.Hour
+
+// How often and how soon a domain that failed with a transient error is
+// crawled again
+type retryPolicy struct {
+	maxAttempts int
+	backoff     time.Duration // Wait after the first failure, doubled after each one that follows
+}
+
+// Wait before the next attempt after the given number of failures
+func (policy retryPolicy) delay(attempts int) time.Duration {
+	delay := policy.backoff
+	for i := 1; i < attempts && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// Errors that may go away by themselves. Everything else, like a name that
+// does not exist or a bad certificate, is permanent.
+func isTransientError(err error, errorClass string) bool {
+	switch errorClass {
+	case core.ErrorClassTimeout, core.ErrorClassConnectionRefused, core.ErrorClassConnectionReset,
+		core.ErrorClassTooManyOpenFiles:
+		return true
+	case core.ErrorClassDNS:
+		var dnsError *net.DNSError
+		return errors.As(err, &dnsError) && !dnsError.IsNotFound && (dnsError.IsTimeout || dnsError.IsTemporary)
+	}
+	return false
+}
+
+// Record a failed crawl, scheduling another attempt if the error is
+// transient and the domain has attempts left
+func (policy retryPolicy) recordFailure(domain *core.Domain, err error, errorClass string) {
+	domain.Attempts++
+	domain.ErrorClass = errorClass
+	domain.ErrorMessage = err.Error()
+	if isTransientError(err, errorClass) && domain.Attempts < policy.maxAttempts {
+		domain.Status = core.StatusRetry
+		domain.NextAttempt = time.Now().Add(policy.delay(domain.Attempts))
+	} else {
+		domain.Status = core.StatusFailed
+		domain.NextAttempt = time.Time{}
+	}
+}
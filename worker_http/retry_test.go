@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+)
+
+// The errors as an http.Client returns them
+func requestError(err error) error {
+	return &url.Error{Op: "Get", URL: "http://example.com/", Err: err}
+}
+
+func dialError(err error) error {
+	return requestError(&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)})
+}
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		class     string
+		transient bool
+	}{
+		{"DNS not found", requestError(&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true}), core.ErrorClassDNS, false},
+		{"DNS temporary failure", requestError(&net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true}), core.ErrorClassDNS, true},
+		{"DNS timeout", requestError(&net.DNSError{Err: "i/o timeout", Name: "example.com", IsTimeout: true}), core.ErrorClassDNS, true},
+		{"DNS other", requestError(&net.DNSError{Err: "bad response", Name: "example.com"}), core.ErrorClassDNS, false},
+		{"deadline", requestError(context.DeadlineExceeded), core.ErrorClassTimeout, true},
+		{"read timeout", requestError(&net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}), core.ErrorClassTimeout, true},
+		{"connection refused", dialError(syscall.ECONNREFUSED), core.ErrorClassConnectionRefused, true},
+		{"connection reset", requestError(&net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}), core.ErrorClassConnectionReset, true},
+		{"closed without a response", requestError(io.EOF), core.ErrorClassConnectionReset, true},
+		{"too many open files", dialError(syscall.EMFILE), core.ErrorClassTooManyOpenFiles, true},
+		{"unknown certificate authority", requestError(x509.UnknownAuthorityError{}), core.ErrorClassTLS, false},
+		{"bad request", errBadRequest, core.ErrorClassBadRequest, false},
+		{"too many redirects", requestError(errTooManyRedirects), core.ErrorClassTooManyRedirects, false},
+		{"other", requestError(io.ErrShortWrite), core.ErrorClassOther, false},
+	}
+	for _, test := range tests {
+		class := classifyError(test.err)
+		if class != test.class {
+			t.Errorf("%s: classified as %s, want %s", test.name, class, test.class)
+		}
+		if transient := isTransientError(test.err, class); transient != test.transient {
+			t.Errorf("%s: transient is %v, want %v", test.name, transient, test.transient)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 100, backoff: time.Hour}
+	for attempts, want := range map[int]time.Duration{
+		1:   time.Hour,
+		2:   2 * time.Hour,
+		3:   4 * time.Hour,
+		8:   128 * time.Hour,
+		9:   maxRetryDelay,
+		100: maxRetryDelay,
+	} {
+		if delay := policy.delay(attempts); delay != want {
+			t.Errorf("delay after %d attempts is %s, want %s", attempts, delay, want)
+		}
+	}
+	if delay := (retryPolicy{backoff: 30 * 24 * time.Hour}).delay(1); delay != maxRetryDelay {
+		t.Errorf("first delay is %s, want it capped at %s", delay, maxRetryDelay)
+	}
+}
+
+func TestRecordFailure(t *testing.T) {
+	policy := retryPolicy{maxAttempts: 3, backoff: time.Minute}
+	transient := dialError(syscall.ECONNREFUSED)
+	var domain core.Domain
+	for attempt := 1; attempt <= 3; attempt++ {
+		start := time.Now()
+		policy.recordFailure(&domain, transient, core.ErrorClassConnectionRefused)
+		if domain.Attempts != attempt || domain.ErrorClass != core.ErrorClassConnectionRefused || domain.ErrorMessage != transient.Error() {
+			t.Fatalf("attempt %d recorded %d attempts, class %s and message %q", attempt, domain.Attempts, domain.ErrorClass, domain.ErrorMessage)
+		}
+		if attempt == 3 {
+			break
+		}
+		wait := domain.NextAttempt.Sub(start)
+		if domain.Status != core.StatusRetry || wait < policy.delay(attempt) || wait > policy.delay(attempt)+time.Second {
+			t.Errorf("attempt %d set status %q retrying in %s, want a retry in %s", attempt, domain.Status, wait, policy.delay(attempt))
+		}
+	}
+	if domain.Status != core.StatusFailed || !domain.NextAttempt.IsZero() {
+		t.Errorf("after the last attempt the status is %q with a retry at %s, want failed", domain.Status, domain.NextAttempt)
+	}
+
+	// Permanent errors fail at once
+	domain = core.Domain{}
+	notFound := requestError(&net.DNSError{Err: "no such host", Name: "example.com", IsNotFound: true})
+	policy.recordFailure(&domain, notFound, classifyError(notFound))
+	if domain.Status != core.StatusFailed || domain.Attempts != 1 || !domain.NextAttempt.IsZero() {
+		t.Errorf("permanent error set status %q after %d attempts with a retry at %s", domain.Status, domain.Attempts, domain.NextAttempt)
+	}
+}
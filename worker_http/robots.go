@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+)
+
+const (
+	maxRobotsSize       = 500 * 1024 // Only the first 500 KiB have to be parsed
+	maxRobotsRedirects  = 5
+	robotsCacheDuration = 24 * time.Hour
+	robotsCacheSize     = 100000 // Entries kept before the cache is cleared
+	maxCrawlDelay       = time.Minute
+)
+
+// How robots.txt is used
+const (
+	robotsStrict   = "strict"   // Do not crawl disallowed domains
+	robotsAdvisory = "advisory" // Only record what robots.txt says
+	robotsOff      = "off"
+)
+
+// A single Allow or Disallow line
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// The lines following one or more User-agent lines
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// Parse a robots.txt file as described in RFC 9309. Crawl-delay is not part
+// of the RFC but is kept with the group it appears in.
+func parseRobots(body []byte) []*robotsGroup {
+	var (
+		groups      []*robotsGroup
+		group       *robotsGroup
+		lastWasRule = true
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 0, 4096), maxRobotsSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if pos := strings.Index(line, "#"); pos > -1 {
+			line = line[:pos]
+		}
+		pos := strings.Index(line, ":")
+		if pos == -1 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(line[:pos]))
+		value := strings.TrimSpace(line[pos+1:])
+
+		switch key {
+		case "user-agent":
+			// Consecutive User-agent lines share one group
+			if lastWasRule {
+				group = &robotsGroup{}
+				groups = append(groups, group)
+			}
+			group.agents = append(group.agents, strings.ToLower(value))
+			lastWasRule = false
+		case "allow", "disallow":
+			lastWasRule = true
+			if group == nil || value == "" {
+				continue
+			}
+			group.rules = append(group.rules, robotsRule{allow: key == "allow", pattern: value})
+		case "crawl-delay":
+			lastWasRule = true
+			if group == nil {
+				continue
+			}
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+				group.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+	}
+	return groups
+}
+
+// Whether a robots.txt path pattern matches the start of path. * matches any
+// characters and a $ at the end anchors the pattern to the end of path.
+func robotsPatternMatches(pattern string, path string) bool {
+	switch {
+	case pattern == "":
+		return true
+	case pattern == "$":
+		return path == ""
+	case pattern[0] == '*':
+		for i := 0; i <= len(path); i++ {
+			if robotsPatternMatches(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	return path != "" && path[0] == pattern[0] && robotsPatternMatches(pattern[1:], path[1:])
+}
+
+// The groups that apply to the agent, falling back to the * groups
+func robotsGroupsFor(groups []*robotsGroup, agent string) []*robotsGroup {
+	var exact, wildcard []*robotsGroup
+	for _, group := range groups {
+		for _, groupAgent := range group.agents {
+			if groupAgent == agent {
+				exact = append(exact, group)
+				break
+			}
+			if groupAgent == "*" {
+				wildcard = append(wildcard, group)
+				break
+			}
+		}
+	}
+	if len(exact) > 0 {
+		return exact
+	}
+	return wildcard
+}
+
+// Decide whether the agent may request path. The longest matching rule wins
+// and Allow wins a tie.
+func robotsAllows(groups []*robotsGroup, agent string, path string) (bool, time.Duration) {
+	allowed := true
+	longest := -1
+	var crawlDelay time.Duration
+	for _, group := range robotsGroupsFor(groups, agent) {
+		if group.crawlDelay > crawlDelay {
+			crawlDelay = group.crawlDelay
+		}
+		for _, rule := range group.rules {
+			if !robotsPatternMatches(rule.pattern, path) {
+				continue
+			}
+			if len(rule.pattern) > longest || len(rule.pattern) == longest && rule.allow {
+				allowed, longest = rule.allow, len(rule.pattern)
+			}
+		}
+	}
+	return allowed, crawlDelay
+}
+
+type robotsCacheEntry struct {
+	decision    core.RobotsDecision
+	lastRequest time.Time // Used to space requests by the crawl delay
+}
+
+// Fetches, caches and applies robots.txt for every host crawled
+type robotsPolicy struct {
+	mode string
+
+	mutex sync.Mutex
+	cache map[string]*robotsCacheEntry
+}
+
+func newRobotsPolicy(mode string) *robotsPolicy {
+	return &robotsPolicy{mode: mode, cache: make(map[string]*robotsCacheEntry)}
+}
+
+// Product token matched against User-agent lines, e.g. webgenome
+func robotsAgent(userAgent string) string {
+	fields := strings.Fields(userAgent)
+	if len(fields) == 0 {
+		return "*"
+	}
+	return strings.ToLower(strings.SplitN(fields[0], "/", 2)[0])
+}
+
+// Look up the decision for the host, fetching robots.txt when it is not
+// cached or too old
+func (policy *robotsPolicy) decide(ctx context.Context, httpFetcher *fetcher, host string) core.RobotsDecision {
+	policy.mutex.Lock()
+	entry, found := policy.cache[host]
+	policy.mutex.Unlock()
+	if found && time.Since(entry.decision.Checked) < robotsCacheDuration {
+		return entry.decision
+	}
+
+	decision := core.RobotsDecision{Checked: time.Now()}
+	statusCode, body, err := httpFetcher.fetchRobots(ctx, host)
+	switch {
+	case err != nil:
+		decision.Result = core.RobotsError
+	case statusCode >= 500:
+		decision.Result = core.RobotsUnreachable
+	case statusCode >= 400:
+		decision.Result = core.RobotsMissing
+	case statusCode >= 300: // Too many redirects
+		decision.Result = core.RobotsMissing
+	default:
+		allowed, crawlDelay := robotsAllows(parseRobots(body), robotsAgent(httpFetcher.userAgent), "/")
+		decision.Result = core.RobotsDisallowed
+		if allowed {
+			decision.Result = core.RobotsAllowed
+		}
+		decision.CrawlDelay = crawlDelay
+	}
+
+	policy.mutex.Lock()
+	if len(policy.cache) >= robotsCacheSize {
+		policy.cache = make(map[string]*robotsCacheEntry)
+	}
+	policy.cache[host] = &robotsCacheEntry{decision: decision, lastRequest: time.Now()}
+	policy.mutex.Unlock()
+	return decision
+}
+
+// In strict mode domains that disallow the root page or fail with a server
+// error are not crawled
+func (policy *robotsPolicy) blocks(decision core.RobotsDecision) bool {
+	return policy.mode == robotsStrict &&
+		(decision.Result == core.RobotsDisallowed || decision.Result == core.RobotsUnreachable)
+}
+
+// Sleep until the crawl delay since the last request to the host has passed
+func (policy *robotsPolicy) wait(ctx context.Context, host string) {
+	if policy.mode != robotsStrict {
+		return
+	}
+	policy.mutex.Lock()
+	entry, found := policy.cache[host]
+	var delay time.Duration
+	if found && entry.decision.CrawlDelay > 0 {
+		crawlDelay := entry.decision.CrawlDelay
+		if crawlDelay > maxCrawlDelay {
+			crawlDelay = maxCrawlDelay
+		}
+		next := entry.lastRequest.Add(crawlDelay)
+		delay = time.Until(next)
+		if delay < 0 {
+			next = time.Now()
+		}
+		entry.lastRequest = next
+	}
+	policy.mutex.Unlock()
+
+	if delay > 0 {
+		logInfo("Waiting " + delay.String() + " for the crawl delay of " + host)
+		select {
+		case <-ctx.Done():
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Request robots.txt from the first URL of the domain that answers
+func (f *fetcher) fetchRobots(ctx context.Context, domainName string) (int, []byte, error) {
+	client := &http.Client{
+		Transport: newTransport(),
+		Timeout:   f.httpTimeout,
+		CheckRedirect: func(request *http.Request, via []*http.Request) error {
+			if len(via) >= maxRobotsRedirects {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+	var err error
+	for _, url := range f.urlsForDomain(domainName) {
+		var request *http.Request
+		request, err = http.NewRequestWithContext(ctx, "GET", url+"robots.txt", nil)
+		if err != nil {
+			return 0, nil, err
+		}
+		request.Header.Set("User-Agent", f.userAgent)
+		request.Close = true
+
+		var response *http.Response
+		response, err = client.Do(request)
+		if err != nil {
+			continue
+		}
+		body, err := io.ReadAll(io.LimitReader(response.Body, maxRobotsSize))
+		response.Body.Close()
+		return response.StatusCode, body, err
+	}
+	return 0, nil, err
+}
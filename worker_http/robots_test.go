@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+)
+
+const testRobots = `# Comments and unknown lines are ignored
+Sitemap: https://example.com/sitemap.xml
+
+User-agent: WebGenome
+User-agent: otherbot
+Disallow: /private   # Trailing comment
+Allow: /private/public
+Crawl-delay: 2.5
+
+User-agent: *
+Disallow: /
+Allow: /$
+Allow: /docs
+Disallow: /docs/
+Allow: /tie
+Disallow: /tie
+Disallow: /*.pdf$
+Crawl-delay: 1
+
+User-agent: emptybot
+Disallow:
+
+user-agent: webgenome
+disallow: /tmp
+`
+
+func TestRobotsAllows(t *testing.T) {
+	groups := parseRobots([]byte(testRobots))
+	tests := []struct {
+		agent      string
+		path       string
+		allowed    bool
+		crawlDelay time.Duration
+	}{
+		// Groups named after the agent, which all apply
+		{"webgenome", "/", true, 2500 * time.Millisecond},
+		{"webgenome", "/private", false, 2500 * time.Millisecond},
+		{"webgenome", "/private/page", false, 2500 * time.Millisecond},
+		{"webgenome", "/private/public/page", true, 2500 * time.Millisecond},
+		{"webgenome", "/tmp/file", false, 2500 * time.Millisecond},
+		{"webgenome", "/docs/", true, 2500 * time.Millisecond},
+		{"otherbot", "/private", false, 2500 * time.Millisecond},
+		{"otherbot", "/tmp/file", true, 2500 * time.Millisecond},
+		// Everyone else falls back to *
+		{"somebot", "/", true, time.Second},
+		{"somebot", "/page", false, time.Second},
+		{"somebot", "/docs", true, time.Second},
+		{"somebot", "/docs/page", false, time.Second},
+		{"somebot", "/tie", true, time.Second},
+		{"somebot", "/docs.pdf", false, time.Second},
+		{"somebot", "/docs.pdf?download", true, time.Second},
+		// An empty Disallow allows everything
+		{"emptybot", "/", true, 0},
+		{"emptybot", "/page", true, 0},
+	}
+	for _, test := range tests {
+		allowed, crawlDelay := robotsAllows(groups, test.agent, test.path)
+		if allowed != test.allowed || crawlDelay != test.crawlDelay {
+			t.Errorf("robotsAllows(%s, %s) = %v, %s, want %v, %s", test.agent, test.path, allowed, crawlDelay, test.allowed, test.crawlDelay)
+		}
+	}
+
+	// Without a * group everything is allowed to other agents
+	allowed, _ := robotsAllows(parseRobots([]byte("User-agent: webgenome\nDisallow: /\n")), "somebot", "/")
+	if !allowed {
+		t.Error("agent without a group is not allowed")
+	}
+}
+
+func TestRobotsPatternMatches(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		matches bool
+	}{
+		{"", "/page", true},
+		{"/", "/page", true},
+		{"/fish", "/fish.html", true},
+		{"/fish", "/Fish", false},
+		{"/fish/", "/fish", false},
+		{"/fish$", "/fish", true},
+		{"/fish$", "/fish/", false},
+		{"$", "", true},
+		{"*", "", true},
+		{"/*.php", "/index.php", true},
+		{"/*.php", "/dir/index.php?page=1", true},
+		{"/*.php", "/index.html", false},
+		{"/*.php$", "/index.php", true},
+		{"/*.php$", "/index.php?page=1", false},
+		{"/a*b*c", "/axxbyyc", true},
+		{"/a*b*c", "/axxc", false},
+		{"/*/print", "/page/print", true},
+	}
+	for _, test := range tests {
+		if matches := robotsPatternMatches(test.pattern, test.path); matches != test.matches {
+			t.Errorf("robotsPatternMatches(%q, %q) = %v, want %v", test.pattern, test.path, matches, test.matches)
+		}
+	}
+}
+
+func TestRobotsAgent(t *testing.T) {
+	for userAgent, want := range map[string]string{
+		"WebGenome Open Source Web Crawler - https://github.com/DevDungeon/WebGenome/": "webgenome",
+		"Mozilla/5.0 (compatible)": "mozilla",
+		"":                         "*",
+	} {
+		if agent := robotsAgent(userAgent); agent != want {
+			t.Errorf("robotsAgent(%q) = %q, want %q", userAgent, agent, want)
+		}
+	}
+}
+
+func TestRobotsDecide(t *testing.T) {
+	var (
+		statusCode int
+		body       string
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/robots.txt" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(statusCode)
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	f := &fetcher{userAgent: "WebGenome test", httpTimeout: 5 * time.Second, scheme: schemeHTTP}
+
+	tests := []struct {
+		name       string
+		statusCode int
+		body       string
+		result     string
+		crawlDelay time.Duration
+		blocked    bool // In strict mode
+	}{
+		{"allowed", http.StatusOK, "User-agent: *\nDisallow: /private\nCrawl-delay: 3\n", core.RobotsAllowed, 3 * time.Second, false},
+		{"disallowed", http.StatusOK, "User-agent: *\nDisallow: /\n", core.RobotsDisallowed, 0, true},
+		{"disallowed for the agent", http.StatusOK, "User-agent: webgenome\nDisallow: /\n\nUser-agent: *\nAllow: /\n", core.RobotsDisallowed, 0, true},
+		{"empty", http.StatusOK, "", core.RobotsAllowed, 0, false},
+		{"not found", http.StatusNotFound, "User-agent: *\nDisallow: /\n", core.RobotsMissing, 0, false},
+		{"forbidden", http.StatusForbidden, "", core.RobotsMissing, 0, false},
+		{"server error", http.StatusInternalServerError, "", core.RobotsUnreachable, 0, true},
+		{"unavailable", http.StatusServiceUnavailable, "User-agent: *\nAllow: /\n", core.RobotsUnreachable, 0, true},
+	}
+	for _, test := range tests {
+		statusCode, body = test.statusCode, test.body
+		for _, mode := range []string{robotsStrict, robotsAdvisory, robotsOff} {
+			policy := newRobotsPolicy(mode)
+			decision := policy.decide(context.Background(), f, host)
+			if decision.Result != test.result || decision.CrawlDelay != test.crawlDelay {
+				t.Errorf("%s in %s mode: decided %s with crawl delay %s, want %s and %s",
+					test.name, mode, decision.Result, decision.CrawlDelay, test.result, test.crawlDelay)
+			}
+			// Only strict mode obeys robots.txt
+			if blocked := policy.blocks(decision); blocked != (test.blocked && mode == robotsStrict) {
+				t.Errorf("%s in %s mode: blocks is %v", test.name, mode, blocked)
+			}
+		}
+	}
+}
+
+func TestRobotsCrawlDelayWait(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("User-agent: *\nCrawl-delay: 0.2\n"))
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	f := &fetcher{userAgent: "WebGenome test", httpTimeout: 5 * time.Second, scheme: schemeHTTP}
+
+	for _, test := range []struct {
+		mode  string
+		waits bool
+	}{
+		{robotsStrict, true},
+		{robotsAdvisory, false},
+		{robotsOff, false},
+	} {
+		policy := newRobotsPolicy(test.mode)
+		policy.decide(context.Background(), f, host)
+		start := time.Now()
+		policy.wait(context.Background(), host)
+		if waited := time.Since(start) >= 150*time.Millisecond; waited != test.waits {
+			t.Errorf("%s mode waited %s for a crawl delay of 200ms", test.mode, time.Since(start))
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+)
+
+// Splits each batch between unchecked domains and recrawls of stale ones
+type scheduler struct {
+	store        core.DomainStore
+	workerId     string
+	lease        time.Duration
+	batchSize    int
+	recrawl      core.RecrawlPolicy
+	recrawlRatio float64 // Share of the batch reserved for recrawls
+}
+
+func (s *scheduler) recrawling() bool {
+	return s.recrawl.MaxAge > 0 && s.recrawlRatio > 0
+}
+
+// Claim the next batch. Whichever kind of work runs short is made up with
+// the other so the batch stays full.
+func (s *scheduler) nextBatch(ctx context.Context) ([]core.Domain, error) {
+	if !s.recrawling() {
+		return s.store.ClaimDomainsToCheck(ctx, s.workerId, s.batchSize, s.lease)
+	}
+
+	recrawlCount := int(math.Round(float64(s.batchSize) * math.Min(s.recrawlRatio, 1)))
+	recrawls, err := s.store.ClaimDomainsToRecrawl(ctx, s.workerId, recrawlCount, s.lease, s.recrawl)
+	if err != nil {
+		return nil, err
+	}
+	domains, err := s.store.ClaimDomainsToCheck(ctx, s.workerId, s.batchSize-len(recrawls), s.lease)
+	if err != nil {
+		return nil, err
+	}
+	if missing := s.batchSize - len(recrawls) - len(domains); missing > 0 && len(recrawls) == recrawlCount {
+		more, err := s.store.ClaimDomainsToRecrawl(ctx, s.workerId, missing, s.lease, s.recrawl)
+		if err != nil {
+			return nil, err
+		}
+		recrawls = append(recrawls, more...)
+	}
+	logInfo("Batch has " + strconv.Itoa(len(domains)) + " new domains and " + strconv.Itoa(len(recrawls)) + " recrawls")
+	return append(domains, recrawls...), nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DevDungeon/WebGenome/core"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	seenFlushInterval = time.Minute // How often links counted by the seen cache are written to the store
+	maxProbableLinks  = 100000      // Names only the Bloom filter knows whose links are counted before a write
+)
+
+// Names recently upserted, which are known to be in the store. Links to them
+// are counted here and added to their InDegree and DiscoverySources in bulk
+// so popular domains like google.com do not cost a database write on every
+// page. With a Bloom filter links to every name ever added are counted too,
+// apart from the cache so they do not fill it. Those are upserted, so a false
+// positive of the filter costs a write instead of losing the domain.
+type seenCache struct {
+	store   core.DomainStore
+	maxSize int          // Entries kept before the cache is flushed and cleared
+	filter  *bloomFilter // Optional
+	holes   *blackHoles  // Optional, counts the names the flush creates
+
+	mutex    sync.Mutex
+	counts   map[string]core.Links // Links to cached names not saved yet
+	probable map[string]core.Links // Links to names only the filter knows, dropped once saved
+}
+
+func newSeenCache(store core.DomainStore, maxSize int) *seenCache {
+	return &seenCache{
+		store:    store,
+		maxSize:  maxSize,
+		counts:   make(map[string]core.Links),
+		probable: make(map[string]core.Links),
+	}
+}
+
+// Count another link to the name if it is cached or probably in the store.
+// Returns false if the name has to be upserted.
+func (cache *seenCache) hit(ctx context.Context, discovery core.Discovery, parentId primitive.ObjectID) bool {
+	cache.mutex.Lock()
+	if links, found := cache.counts[discovery.Name]; found {
+		addLink(&links, discovery, parentId)
+		cache.counts[discovery.Name] = links
+		cache.mutex.Unlock()
+		return true
+	}
+	if cache.filter == nil || !cache.filter.contains(discovery.Name) {
+		cache.mutex.Unlock()
+		return false
+	}
+	links := cache.probable[discovery.Name]
+	addLink(&links, discovery, parentId)
+	cache.probable[discovery.Name] = links
+	var probable map[string]core.Links
+	if len(cache.probable) >= maxProbableLinks {
+		probable = cache.probable
+		cache.probable = make(map[string]core.Links)
+	}
+	cache.mutex.Unlock()
+	if probable != nil {
+		cache.write(ctx, probable)
+	}
+	return true
+}
+
+// Count the link, remembering where the first one was found in case the
+// domain has to be created
+func addLink(links *core.Links, discovery core.Discovery, parentId primitive.ObjectID) {
+	if links.Count == 0 {
+		links.Parent = parentId
+		links.Port = discovery.Port
+	}
+	links.Add(discovery.Source)
+}
+
+// Remember names that were just upserted, flushing the cache when it is full
+func (cache *seenCache) add(ctx context.Context, discoveries []core.Discovery) {
+	if cache.filter != nil {
+		for _, discovery := range discoveries {
+			cache.filter.add(discovery.Name)
+		}
+	}
+	if cache.maxSize <= 0 {
+		return
+	}
+	cache.mutex.Lock()
+	var counts map[string]core.Links
+	if len(cache.counts)+len(discoveries) > cache.maxSize {
+		counts = cache.counts
+		cache.counts = make(map[string]core.Links)
+	}
+	for _, discovery := range discoveries {
+		cache.counts[discovery.Name] = core.Links{}
+	}
+	cache.mutex.Unlock()
+	cache.write(ctx, counts)
+}
+
+// Write the counted links to the store and reset the counts
+func (cache *seenCache) flush(ctx context.Context) {
+	cache.mutex.Lock()
+	probable := cache.probable
+	cache.probable = make(map[string]core.Links)
+	counts := make(map[string]core.Links)
+	for name, links := range cache.counts {
+		if links.Count > 0 {
+			counts[name] = links
+			cache.counts[name] = core.Links{}
+		}
+	}
+	cache.mutex.Unlock()
+	cache.write(ctx, probable)
+	cache.write(ctx, counts)
+}
+
+func (cache *seenCache) write(ctx context.Context, counts map[string]core.Links) {
+	for name, links := range counts {
+		if links.Count == 0 {
+			delete(counts, name)
+		}
+	}
+	inserted, err := cache.store.AddLinks(ctx, counts)
+	if err != nil {
+		logError("Error saving the links to " + strconv.Itoa(len(counts)) + " domains. " + err.Error())
+	}
+	if cache.holes != nil {
+		for _, discovery := range inserted {
+			cache.holes.addSubdomain(ctx, discovery.Name)
+		}
+	}
+}
+
+// Flush the cache every seenFlushInterval until ctx is done
+func (cache *seenCache) flushPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(seenFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			cache.flush(ctx)
+		}
+	}
+}
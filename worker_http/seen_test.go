@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/DevDungeon/WebGenome/core"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestSeenCacheBloomHitsDoNotFillCache(t *testing.T) {
+	ctx := context.Background()
+	store, err := core.NewBoltStore(filepath.Join(t.TempDir(), "test.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if _, err = store.UpsertDiscoveredDomains(ctx, []core.Discovery{{Name: "example.com"}}, primitive.NilObjectID); err != nil {
+		t.Fatal(err)
+	}
+
+	// Known from an earlier run, so only the filter has the name
+	cache := newSeenCache(store, 10)
+	cache.filter = newBloomFilter(100, 0.001)
+	cache.filter.add("example.com")
+	parent := primitive.NewObjectID()
+	for i := 0; i < 3; i++ {
+		if !cache.hit(ctx, core.Discovery{Name: "example.com", Source: core.SourceAnchor}, parent) {
+			t.Fatal("name in the Bloom filter was not counted")
+		}
+	}
+	// A false positive of the filter, which the store does not have
+	cache.filter.add("new.example.org")
+	if !cache.hit(ctx, core.Discovery{Name: "new.example.org", Port: 8080, Source: core.SourceScript}, parent) {
+		t.Fatal("name in the Bloom filter was not counted")
+	}
+	if cache.hit(ctx, core.Discovery{Name: "unknown.example.org"}, parent) {
+		t.Error("unknown name was counted")
+	}
+	if len(cache.counts) != 0 {
+		t.Errorf("Bloom hits added %d entries to the cache", len(cache.counts))
+	}
+
+	cache.flush(ctx)
+	if len(cache.probable) != 0 {
+		t.Errorf("%d Bloom hits kept after the flush", len(cache.probable))
+	}
+	domain, err := store.GetDomainByName(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if domain.InDegree != 3 || len(domain.DiscoverySources) != 1 {
+		t.Errorf("flush saved InDegree %d and sources %v, want 3 and [a]", domain.InDegree, domain.DiscoverySources)
+	}
+	domain, err = store.GetDomainByName(ctx, "new.example.org")
+	if err != nil {
+		t.Fatalf("false positive of the filter was not created by the flush: %v", err)
+	}
+	if domain.InDegree != 1 || domain.ParentDomain != parent || domain.Port != 8080 || domain.DiscoverySource != core.SourceScript {
+		t.Errorf("flush created %+v", domain)
+	}
+}
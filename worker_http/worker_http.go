@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"runtime"
 	"strconv"
@@ -11,11 +13,14 @@ import (
 
 	"github.com/DevDungeon/WebGenome/core"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/docopt/docopt-go"
 	"github.com/fatih/color"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	maxBodySize  = 5 * 1024 * 1024 // Larger bodies are truncated before parsing for links
+	maxRedirects = 10
 )
 
 var (
@@ -59,316 +64,264 @@ func check(err error) {
 	}
 }
 
-func appendIfNotExists(strings []string, newString string) []string {
-	exists := false
-	for _, existingString := range strings {
-		if existingString == newString {
-			exists = true
+// Pull out the headers from an HTTP response
+func headersFromResponse(responseHeader http.Header) []core.Header {
+	var headers []core.Header
+	for key, value := range responseHeader {
+		if key == "Date" { // Ignore the Date header
+			continue
 		}
+		header := core.Header{Key: key, Value: value[0]}
+		if len(value) > 1 { // Keep every Set-Cookie, Link, Vary etc.
+			header.Values = value
+		}
+		headers = append(headers, header)
 	}
-	if !exists {
-		strings = append(strings, newString)
-	}
-	return strings
+	return headers
 }
 
-// Extract URLs from HTML document
-func getUniqueDomainsFromResponse(response *http.Response) ([]string, error) {
-	doc, err := goquery.NewDocumentFromReader(response.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	// Get all a hrefs
-	var domains []string
-	doc.Find("a").Each(func(i int, s *goquery.Selection) {
-		href, exists := s.Attr("href")
-		if exists {
-			cleanDomain, found := getDomainFromHref(href)
-			if found {
-				domains = appendIfNotExists(domains, cleanDomain)
-			}
+// Add new domains to database if they don't already exist. Domains seen
+// recently are only counted.
+func (c *crawler) addDiscoveredDomains(ctx context.Context, scope *crawlScope, parent core.Domain, found []core.Discovery) {
+	var upserts []core.Discovery
+	for _, discovery := range found {
+		if c.holes.contains(discovery.Name) || scope.excludes(discovery.Name) != "" || c.seen.hit(ctx, discovery, parent.Id) {
+			continue
 		}
-	})
-	return domains, nil
-}
-
-// Clean up an href and find the root domain if available
-// handle things like: protocol prefixes, mailto links, trailing slashes
-// trailing hash
-func getDomainFromHref(href string) (domain string, found bool) {
-	// If it is too short it can't be a domain and is probably just a /
-	if len(href) < 3 {
-		return "", false
-	}
-
-	// If it starts right off with a slash, it is a relative URL and no domain
-	if href[0] == '/' {
-		return "", false
-	}
-
-	// If there are double slashes, strip them and everything before
-	pos := strings.Index(href, "//")
-	if pos > -1 {
-		href = href[pos+2:]
-	} else {
-		return "", false // No protocol, treat as relative and skip
-	}
-
-	// If it is a mailto, then strip the mailto,
-	pos = strings.Index(href, "mailto:")
-	if pos > -1 {
-		href = href[pos+7:]
-	}
-
-	// Remove any spaces and anything after
-	pos = strings.Index(href, " ")
-	if pos > -1 {
-		href = href[:pos]
-	}
-
-	// Remove any username@ portion
-	pos = strings.Index(href, "@")
-	if pos > -1 {
-		href = href[:pos]
-	}
-
-	// Remove any ? and after
-	pos = strings.Index(href, "?")
-	if pos > -1 {
-		href = href[:pos]
+		upserts = append(upserts, discovery)
 	}
-
-	// Remove any & and after
-	pos = strings.Index(href, "&")
-	if pos > -1 {
-		href = href[:pos]
-	}
-
-	// Remove any % and after
-	pos = strings.Index(href, "%")
-	if pos > -1 {
-		href = href[:pos]
+	if len(upserts) == 0 {
+		return
 	}
-
-	// If there are still any more slashes they are at the end
-	// so trim them and anything after
-	pos = strings.Index(href, "/")
-	if pos > -1 {
-		href = href[:pos]
+	inserted, err := c.store.UpsertDiscoveredDomains(ctx, upserts, parent.Id)
+	if err != nil {
+		logError("Error inserting domains found in: " + parent.Name + ". " + err.Error())
+		return
 	}
-
-	// Strip # and everything after
-	pos = strings.Index(href, "#")
-	if pos > -1 {
-		href = href[:pos]
+	c.seen.add(ctx, upserts)
+	for _, discovery := range inserted {
+		c.holes.addSubdomain(ctx, discovery.Name)
 	}
-
-	if !validateDomain(href) {
-		return "", false
-	}
-
-	// if no good domain name obtained, return false
-	return strings.ToLower(href), true
 }
 
-func validateDomain(domain string) bool {
-	if len(domain) < 3 {
-		return false
-	}
-
-	splitDomain := strings.Split(domain, ".")
-	if len(splitDomain) < 2 { // There is not two parts to the domain
-		return false
-	}
-
-	if len(splitDomain[0]) < 1 {
-		return false
-	}
-	if len(splitDomain[1]) < 2 {
-		return false
-	}
-
-	return true
+// Hand the domain back to the store without crawling it. No worker can
+// claim it again before retryAt.
+func deferDomain(ctx context.Context, store core.DomainStore, workerId string, domain core.Domain, retryAt time.Time) error {
+	logInfo("Deferring " + domain.Name + " until " + retryAt.Format(time.RFC3339))
+	domain.ClaimedBy = ""
+	domain.LeaseExpires = retryAt
+	return store.UpdateDomain(ctx, workerId, domain)
 }
 
-func getDotCount(text string) int {
-	// How many periods are in the text
-	var dotCount int = 0
-	for i := 0; i < len(text); i++ {
-		if string(text[i]) == "." {
-			dotCount++
-		}
-	}
-	return dotCount
+// Give up the lease on a domain that was claimed but not crawled so any
+// worker can claim it right away
+func releaseDomain(ctx context.Context, store core.DomainStore, workerId string, domain core.Domain) error {
+	domain.ClaimedBy = ""
+	domain.LeaseExpires = time.Time{}
+	return store.UpdateDomain(ctx, workerId, domain)
 }
 
-func areFirstFourLettersWwwDot(text string) bool {
-	if len(text) < 4 {
-		return false
+// Mark the domain as checked now. Saving it afterwards releases the lease.
+func startCheck(domain *core.Domain) {
+	domain.LastChecked = time.Now()
+	if domain.RegistrableDomain == "" { // Added by an older version
+		domain.RegistrableDomain, _ = core.RegistrableDomain(domain.Name)
 	}
-	return text[0:4] == "www."
+	domain.Skipped = false // Replaced by Status
+	domain.ClaimedBy = ""
+	domain.LeaseExpires = time.Time{}
 }
 
-func processDomain(domain core.Domain, httpTimeout time.Duration, doneChannel chan bool, dbConn *mgo.Collection) {
-
-	var (
-		err       error
-		userAgent string = "WebGenome Open Source Web Crawler - https://github.com/DevDungeon/WebGenome/"
-	)
-	domain.LastChecked = time.Now()
+// Everything a crawl needs apart from the domain
+type crawler struct {
+	store        core.DomainStore
+	workerId     string
+	settings     *crawlSettings
+	retries      retryPolicy
+	robots       *robotsPolicy
+	polite       *politeness
+	holes        *blackHoles
+	seen         *seenCache
+	fingerprints *core.Fingerprinter
+}
 
-	// Ignore some subdomains. These are like black holes with almost infinite subdomains
-	// TODO Move this to a config file
-	ignoredDomains := []string{
-		".blogspot.com",
-		".tumblr.com",
-		".booked.net",
-		".deviantart.com",
-		".zxdyw.com",
-		".fang.com",
-		".8671.net",
-		".cityhouse.cn",
-		".zjdyhyjx.com",
-		".sanguoyule.com",
-		".tw066.com",
-		".862sc.com",
-		".mkedu.cn",
-		".hbsfgk.org",
-		".changdets.com",
-		".ycwyw.cn",
-	}
-	for _, ignoredDomain := range ignoredDomains {
-		pos := strings.Index(domain.Name, ignoredDomain)
-		if pos > -1 {
-			logInfo("Skipping ignored subdomain: " + domain.Name)
-			domain.Skipped = true
-			err = dbConn.Update(
-				bson.M{"_id": domain.Id},
-				domain,
-			)
-			check(err)
-			doneChannel <- true
-			return
+// Crawl the domain and save the result. Returns the outcome for the summary,
+// which is the new status of the domain unless it was deferred or released.
+// Errors are from the store and mean the worker has to stop, apart from
+// core.ErrLeaseLost when another worker has taken the domain over.
+func (c *crawler) processDomain(ctx context.Context, domain core.Domain) (string, error) {
+	store := c.store
+	workerId := c.workerId
+	// Requests stop when ctx is cancelled but results are always saved
+	saveCtx := context.WithoutCancel(ctx)
+
+	// Settings may be reloaded at any time so use the same ones for the whole crawl
+	httpFetcher := c.settings.fetcher.Load()
+	scope := c.settings.scope.Load()
+
+	// Domains that are ignored do not wait for their site or address
+	reason := scope.excludes(domain.Name)
+	if reason == "" {
+		reason = scope.excludesAddress(ctx, domain.Name)
+	}
+	if reason != "" {
+		logInfo("Skipping out of scope domain: " + domain.Name + " (" + reason + ")")
+		startCheck(&domain)
+		domain.Status = core.StatusIgnored
+		return string(domain.Status), store.UpdateDomain(saveCtx, workerId, domain)
+	}
+
+	// Some sites are like black holes with almost infinite subdomains
+	if c.holes.contains(domain.Name) {
+		logInfo("Skipping subdomain of quarantined site: " + domain.Name)
+		startCheck(&domain)
+		domain.Status = core.StatusIgnored
+		return string(domain.Status), store.UpdateDomain(saveCtx, workerId, domain)
+	}
+
+	// Put the domain off while its site or address is busy
+	site := siteOf(domain.Name)
+	retryAt, started := c.polite.startSite(site)
+	if !started {
+		return outcomeDeferred, deferDomain(saveCtx, store, workerId, domain, retryAt)
+	}
+	defer c.polite.finishSite(site)
+	ip, retryAt, started := c.polite.startIP(ctx, domain.Name)
+	if !started {
+		return outcomeDeferred, deferDomain(saveCtx, store, workerId, domain, retryAt)
+	}
+	defer c.polite.finishIP(ip)
+
+	var err error
+	startCheck(&domain)
+
+	if c.robots.mode != robotsOff {
+		decision := c.robots.decide(ctx, httpFetcher, domain.Name)
+		domain.Robots = &decision
+		if c.robots.blocks(decision) {
+			logInfo("Blocked by robots.txt (" + decision.Result + "): " + domain.Name)
+			domain.Status = core.StatusBlocked
+			domain.Attempts = 0
+			domain.NextAttempt = time.Time{}
+			return string(domain.Status), store.UpdateDomain(saveCtx, workerId, domain)
 		}
+		c.robots.wait(ctx, domain.Name)
 	}
 
-	transport := &http.Transport{DisableKeepAlives: true}
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   httpTimeout,
+	result, err := httpFetcher.fetchDomain(ctx, domain.Name)
+	if err != nil && ctx.Err() != nil {
+		// Aborted by a shutdown, not the domain's fault
+		logInfo("Releasing interrupted domain: " + domain.Name)
+		return outcomeReleased, releaseDomain(saveCtx, store, workerId, domain)
 	}
-	request, err := http.NewRequest("GET", "http://"+domain.Name+"/", nil)
 	if err != nil {
-		logError("Problem creating HTTP GET request for " + domain.Name + ". Setting skipped.")
-		domain.Skipped = true
-		err = dbConn.Update(
-			bson.M{"_id": domain.Id},
-			domain,
-		)
-		check(err)
-		doneChannel <- true
-		return
-	}
-
-	request.Header.Set("User-Agent", userAgent)
-	request.Close = true
-	request.Header.Set("Connection", "close") // Double check the connection is closed
-	response, err := client.Do(request)
-	if response != nil {
-		defer response.Body.Close()
-	}
-	if err != nil {
-		domain.Skipped = true
-		logWarning("Problem with " + domain.Name + ". Setting skipped. " + err.Error())
-		if strings.Contains(err.Error(), "too many open files") {
+		c.retries.recordFailure(&domain, err, classifyError(err))
+		if domain.Status == core.StatusRetry {
+			logWarning("Problem with " + domain.Name + " (" + domain.ErrorClass + "). Retrying after " + domain.NextAttempt.Format(time.RFC3339) + ". " + err.Error())
+		} else {
+			logWarning("Problem with " + domain.Name + ". Setting failed (" + domain.ErrorClass + ") after " + strconv.Itoa(domain.Attempts) + " attempts. " + err.Error())
+		}
+		if domain.ErrorClass == core.ErrorClassTooManyOpenFiles {
 			logError("Detecting too many files open error. Waiting 30 seconds.")
-			time.Sleep(30 * time.Second)
-			logInfo("Thread done waiting for 30 seconds.")
+			select {
+			case <-ctx.Done():
+			case <-time.After(30 * time.Second):
+				logInfo("Thread done waiting for 30 seconds.")
+			}
 		}
-		err = dbConn.Update(
-			bson.M{"_id": domain.Id},
-			domain,
-		)
-		check(err)
-		doneChannel <- true
-		return
-	}
-
-	// Pull out the headers from the HTTP response
-	for key, value := range response.Header {
-		if key == "Date" { // Ignore the Date header
-			continue
+		domain.ResponseInfo = result.responseInfo
+		if err = store.UpdateDomain(saveCtx, workerId, domain); err != nil {
+			return outcomeError, err
 		}
-		header := core.Header{key, value[0]}
-		domain.Headers = append(domain.Headers, header)
+		c.addDiscoveredDomains(saveCtx, scope, domain, discoverFromResult(domain.Name, result).found)
+		return string(domain.Status), nil
 	}
 
+	// Keep a snapshot of this crawl and replace the previous headers
+	observationId, err := store.AddObservation(saveCtx, core.Observation{
+		DomainId:     domain.Id,
+		Time:         domain.LastChecked,
+		IP:           result.remoteIP,
+		Headers:      result.headers,
+		ResponseInfo: result.responseInfo,
+	})
+	if err != nil {
+		return outcomeError, err
+	}
+	domain.Headers = result.headers
+	domain.LatestObservation = observationId
+	domain.ResponseInfo = result.responseInfo
+	domain.Status = core.StatusOK
+	domain.ErrorClass = ""
+	domain.ErrorMessage = ""
+	domain.Attempts = 0
+	domain.NextAttempt = time.Time{}
+	domain.Technologies = c.fingerprints.Fingerprint(result.headers, result.body)
+	domain.Fingerprints = c.fingerprints.Version
+
 	// Update domain
-	err = dbConn.Update(
-		bson.M{"_id": domain.Id},
-		domain,
-	)
-	check(err)
+	if err = store.UpdateDomain(saveCtx, workerId, domain); err != nil {
+		return outcomeError, err
+	}
 	logInfo("Updated domain info: " + domain.Name)
 
-	// Parse body for new domains
-	domainsInDocument, err := getUniqueDomainsFromResponse(response)
+	// Headers and the certificate can point at more domains than the body.
+	// Links in the body are relative to the page after redirects.
+	found := discoverFromResult(domain.Name, result)
+	finalUrl, _ := url.Parse(result.responseInfo.FinalURL)
+	err = addBodyDomains(found, result.body, finalUrl)
 	if err != nil {
-		logInfo("Error reading response from: " + domain.Name)
-	}
-	logInfo("Domains found in " + domain.Name + ": " + strings.Join(domainsInDocument, ","))
-
-	// Add new domains to database if they don't already exist
-	for _, foundDomainName := range domainsInDocument {
-
-		// See if domain exists
-		// find count? if count > 0 or exists, move on
-		var existingDomain core.Domain
-		err = dbConn.Find(bson.M{"name": foundDomainName}).One(&existingDomain)
-		if err == mgo.ErrNotFound {
-			//logInfo("Domain not found. Adding: " + foundDomainName) // Just too verbose
-			newDomain := &core.Domain{Name: foundDomainName, ParentDomain: domain.Id}
-			err := dbConn.Insert(newDomain)
-			if err != nil {
-				logError("Error inserting!")
-			}
-		} else if err != nil {
-			logError("Error when looking for existing domain: " + foundDomainName + ". " + err.Error())
-		}
+		logInfo("Error parsing response from: " + domain.Name)
 	}
+	logInfo("Domains found in " + domain.Name + ": " + strings.Join(found.names(), ","))
+	c.addDiscoveredDomains(saveCtx, scope, domain, found.found)
 
-	doneChannel <- true
-	return
-}
-
-// Find unchecked domains (no headers)
-func getDomainsToCheck(limit int, dbConn *mgo.Collection) ([]core.Domain, error) {
-	var uncheckedDomains []core.Domain
-	err := dbConn.Find(
-		bson.M{"headers": bson.M{"$exists": 0}, "skipped": bson.M{"$exists": 0}},
-	).Limit(limit).All(&uncheckedDomains)
-	return uncheckedDomains, err
-
+	return string(domain.Status), nil
 }
 
 func main() {
 	usage := `worker_http - Web Genome HTTP Worker.
 
 Usage:
-  worker_http --host=<host> --database=<dbname> --collection=<collectionname> --max-threads=<maxthreads> --http-timeout=<seconds> --batch-size=<batchsize> [--verbose]
+  worker_http [--store=<backend>] [--host=<host>] [--database=<dbname>] [--collection=<collectionname>] [--db-file=<path>] [--seed=<domain>] --max-threads=<maxthreads> [--http-timeout=<seconds>] --batch-size=<batchsize> [--scheme=<scheme>] [--max-attempts=<attempts>] [--retry-backoff=<seconds>] [--worker-id=<id>] [--lease=<seconds>] [--recrawl-age=<hours>] [--popular-recrawl-age=<hours>] [--popular-in-degree=<count>] [--recrawl-ratio=<ratio>] [--robots=<mode>] [--site-threads=<count>] [--site-rate=<rate>] [--ip-threads=<count>] [--ip-rate=<rate>] [--max-subdomains=<count>] [--release-site=<site>] [--seen-cache=<count>] [--bloom-capacity=<count>] [--bloom-fp-rate=<rate>] [--bloom-snapshot=<file>] [--fingerprints=<path>] [--serve=<address>] [--config=<file>] [--verbose]
   worker_http -h | --help
   worker_http --version
 
 Options:
   -h --help                   Show this screen.
   --version                   Show version.
-  --host=<host>               MongoDB host
-  --database=<database>       MongoDB database name.
-  --collection=<collection>   MongoDB collection name.
+  --store=<backend>           Storage backend, mongo or bolt [default: mongo].
+  --host=<host>               MongoDB host [default: localhost].
+  --database=<database>       MongoDB database name [default: webgenome].
+  --collection=<collection>   MongoDB collection name [default: domains].
+  --db-file=<path>            BoltDB file used by the bolt backend [default: webgenome.db].
+  --seed=<domain>             Add a domain to start crawling from.
   --max-threads=<maxthreads>  Maximum number of simultaneous threads.
-  --http-timeout=<seconds>    How long before HTTP requests timeout in seconds.
-  --batch-size=<batchsize>    How many unchecked domains to pull and run per loop
+  --http-timeout=<seconds>    How long before HTTP requests timeout in seconds [default: 30].
+  --scheme=<scheme>           http, https or https-first to fall back to http [default: http].
+  --batch-size=<batchsize>    How many domains to claim at a time and keep queued for the threads
+  --max-attempts=<attempts>   Crawls of a domain with transient errors before it is marked failed [default: 5].
+  --retry-backoff=<seconds>   Wait before retrying a domain, doubled after every failure [default: 300].
+  --worker-id=<id>            Name of this worker in domain leases, defaults to hostname and process id.
+  --lease=<seconds>           How long claimed domains are reserved for this worker without a heartbeat [default: 300].
+  --recrawl-age=<hours>       Crawl checked domains again after this many hours, 0 to never recrawl [default: 0].
+  --popular-recrawl-age=<hours>  Recrawl age for popular domains [default: 24].
+  --popular-in-degree=<count>    Domains found by this many crawls are popular, 0 for none [default: 100].
+  --recrawl-ratio=<ratio>     Share of each batch used for recrawls when there are new domains too [default: 0.2].
+  --robots=<mode>             strict to obey robots.txt, advisory to only record it or off [default: strict].
+  --site-threads=<count>      Simultaneous crawls per registrable domain, 0 for no limit [default: 2].
+  --site-rate=<rate>          Crawls started per second per registrable domain, 0 for no limit [default: 1].
+  --ip-threads=<count>        Simultaneous crawls per IP address, 0 for no limit [default: 8].
+  --ip-rate=<rate>            Crawls started per second per IP address, 0 for no limit [default: 0].
+  --max-subdomains=<count>    Quarantine sites with more subdomains than this, 0 to never quarantine [default: 1000].
+  --release-site=<site>       Lift the quarantine of a registrable domain for good.
+  --seen-cache=<count>        Recently found domains whose links are counted in memory, 0 to disable [default: 100000].
+  --bloom-capacity=<count>    Domains a Bloom filter of known names is sized for, 0 for no filter [default: 0].
+  --bloom-fp-rate=<rate>      Share of new domains the Bloom filter wrongly takes for known ones [default: 0.001].
+  --bloom-snapshot=<file>     Keep the Bloom filter in this file between runs.
+  --fingerprints=<path>       Wappalyzer style technology rules, a JSON file or a directory of them. Defaults to the built in rules.
+  --serve=<address>           Serve the stored domains to the website at this address, e.g. localhost:3001.
+  --config=<file>             YAML file with the crawl scope, user agent and timeout. Reloaded on SIGHUP.
   --verbose                   Increase output verbosity.`
 
 	arguments, err := docopt.Parse(usage, nil, true, "Web Genome Worker", false)
@@ -377,72 +330,276 @@ Options:
 		os.Exit(1)
 	}
 	verbose = arguments["--verbose"].(bool) // Set global var for logging
+	workerId := defaultWorkerId()
+	if arguments["--worker-id"] != nil {
+		workerId = arguments["--worker-id"].(string)
+	}
 	batchSize, err := strconv.Atoi(arguments["--batch-size"].(string))
 	check(err)
 
 	logGreen("====== Options ======")
-	logGreen("Host:         " + arguments["--host"].(string))
-	logGreen("Database:     " + arguments["--database"].(string))
-	logGreen("Collection:   " + arguments["--collection"].(string))
+	logGreen("Store:        " + arguments["--store"].(string))
+	if arguments["--store"].(string) == "bolt" {
+		logGreen("DB file:      " + arguments["--db-file"].(string))
+	} else {
+		logGreen("Host:         " + arguments["--host"].(string))
+		logGreen("Database:     " + arguments["--database"].(string))
+		logGreen("Collection:   " + arguments["--collection"].(string))
+	}
+	logGreen("Worker id:    " + workerId)
+	logGreen("Lease:        " + arguments["--lease"].(string) + " seconds")
 	logGreen("Max threads:  " + arguments["--max-threads"].(string))
 	logGreen("HTTP timeout: " + arguments["--http-timeout"].(string) + " seconds")
 	logGreen("Batch size:   " + strconv.Itoa(batchSize))
+	logGreen("Scheme:       " + arguments["--scheme"].(string))
+	logGreen("Max attempts: " + arguments["--max-attempts"].(string))
+	logGreen("Backoff:      " + arguments["--retry-backoff"].(string) + " seconds")
+	logGreen("Recrawl age:  " + arguments["--recrawl-age"].(string) + " hours, popular " + arguments["--popular-recrawl-age"].(string) + " hours")
+	logGreen("Recrawl mix:  " + arguments["--recrawl-ratio"].(string))
+	logGreen("Robots.txt:   " + arguments["--robots"].(string))
+	logGreen("Per site:     " + arguments["--site-threads"].(string) + " threads, " + arguments["--site-rate"].(string) + " per second")
+	logGreen("Per IP:       " + arguments["--ip-threads"].(string) + " threads, " + arguments["--ip-rate"].(string) + " per second")
+	logGreen("Subdomains:   " + arguments["--max-subdomains"].(string) + " per site")
+	logGreen("Seen cache:   " + arguments["--seen-cache"].(string) + " domains")
+	if arguments["--bloom-capacity"].(string) != "0" {
+		logGreen("Bloom size:   " + arguments["--bloom-capacity"].(string) + " domains, " + arguments["--bloom-fp-rate"].(string) + " false positives")
+	}
+	if arguments["--fingerprints"] != nil {
+		logGreen("Fingerprints: " + arguments["--fingerprints"].(string))
+	}
+	if arguments["--serve"] != nil {
+		logGreen("Serving at:   " + arguments["--serve"].(string))
+	}
+	if arguments["--config"] != nil {
+		logGreen("Config:       " + arguments["--config"].(string))
+	}
 	logGreen("Verbose Mode: " + strconv.FormatBool(verbose))
 	logGreen("=====================")
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
-	session, err := mgo.Dial(arguments["--host"].(string))
+	maxThreads, err := strconv.Atoi(arguments["--max-threads"].(string))
 	check(err)
-	defer session.Close()
 
-	dbConn := session.DB(arguments["--database"].(string)).C(arguments["--collection"].(string))
-	timeout, err := strconv.Atoi(arguments["--http-timeout"].(string))
-	check(err)
-	httpTimeout := time.Duration(time.Duration(timeout) * time.Second)
-	maxThreads, err := strconv.Atoi(arguments["--max-threads"].(string))
+	var fingerprints *core.Fingerprinter
+	if arguments["--fingerprints"] != nil {
+		fingerprints, err = core.LoadFingerprints(arguments["--fingerprints"].(string))
+	} else {
+		fingerprints, err = core.DefaultFingerprinter()
+	}
 	check(err)
+	logGreen("Loaded " + strconv.Itoa(fingerprints.Count()) + " technologies, rules version " + fingerprints.Version)
+	if fingerprints.Skipped > 0 {
+		logError("Skipped " + strconv.Itoa(fingerprints.Skipped) + " technology patterns that are not valid Go regular expressions.")
+	}
 
+	ctx := context.Background()
 	logGreen("Establishing connection with database.")
+	storeOptions := core.StoreOptions{
+		Backend:    arguments["--store"].(string),
+		Host:       arguments["--host"].(string),
+		Database:   arguments["--database"].(string),
+		Collection: arguments["--collection"].(string),
+		PoolSize:   uint64(maxThreads),
+		File:       arguments["--db-file"].(string),
+	}
+	store, err := core.OpenDomainStore(ctx, storeOptions)
+	check(err)
+	defer store.Close()
 	logGreen("Database connection created.")
 
-	totalRuns := 0
-	doneChannel := make(chan bool)
-	numThreads := 0
-	for true {
-		startTime := time.Now()
-		uncheckedDomains, err := getDomainsToCheck(batchSize, dbConn)
+	if arguments["--seed"] != nil {
+		seed, err := core.NormalizeDomainName(arguments["--seed"].(string))
 		check(err)
-		if len(uncheckedDomains) == 0 {
-			logError("No domains found to check. Exiting.")
-			os.Exit(0)
-		}
+		_, err = store.UpsertDiscoveredDomains(
+			ctx,
+			[]core.Discovery{{Name: seed, Source: core.SourceSeed}},
+			primitive.NilObjectID,
+		)
+		check(err)
+	}
 
-		for x := 0; x < len(uncheckedDomains); x += 1 {
-			numThreads += 1
-			totalRuns += 1
+	// The website can not open a Bolt file the worker has open so it reads
+	// through the worker instead
+	var server *http.Server
+	if arguments["--serve"] != nil {
+		server = &http.Server{Addr: arguments["--serve"].(string), Handler: core.NewStoreServer(store)}
+		go func() {
+			if err := server.ListenAndServe(); err != http.ErrServerClosed {
+				logError("Error serving the store. " + err.Error())
+			}
+		}()
+	}
 
-			logGreen("Checking " + uncheckedDomains[x].Name)
-			go processDomain(uncheckedDomains[x], httpTimeout, doneChannel, dbConn)
+	if arguments["--release-site"] != nil {
+		err = store.ReleaseSite(ctx, arguments["--release-site"].(string))
+		check(err)
+	}
+	maxSubdomains, err := strconv.Atoi(arguments["--max-subdomains"].(string))
+	check(err)
+	holes := &blackHoles{store: store, maxSubdomains: maxSubdomains}
 
-			// Wait until a done signal before next if max threads reached
-			if numThreads >= maxThreads {
-				<-doneChannel
-				numThreads -= 1
-			}
-		}
+	timeout, err := strconv.Atoi(arguments["--http-timeout"].(string))
+	check(err)
+	httpTimeout := time.Duration(time.Duration(timeout) * time.Second)
+	if !validScheme(arguments["--scheme"].(string)) {
+		logError("Unknown scheme: " + arguments["--scheme"].(string))
+		os.Exit(1)
+	}
+	settings := &crawlSettings{
+		defaults: fetcher{
+			userAgent:   "WebGenome Open Source Web Crawler - https://github.com/DevDungeon/WebGenome/",
+			httpTimeout: httpTimeout,
+			scheme:      arguments["--scheme"].(string),
+		},
+	}
+	if arguments["--config"] != nil {
+		settings.configPath = arguments["--config"].(string)
+	}
+	err = settings.load()
+	check(err)
+	if settings.configPath != "" {
+		go settings.reloadOnHangup()
+	}
 
-		// Wait for all threads before repeating and fetching a new batch
-		for numThreads > 0 {
-			<-doneChannel
-			numThreads -= 1
-		}
+	robotsMode := arguments["--robots"].(string)
+	if robotsMode != robotsStrict && robotsMode != robotsAdvisory && robotsMode != robotsOff {
+		logError("Unknown robots mode: " + robotsMode)
+		os.Exit(1)
+	}
+	robots := newRobotsPolicy(robotsMode)
+
+	siteThreads, err := strconv.Atoi(arguments["--site-threads"].(string))
+	check(err)
+	siteRate, err := strconv.ParseFloat(arguments["--site-rate"].(string), 64)
+	check(err)
+	ipThreads, err := strconv.Atoi(arguments["--ip-threads"].(string))
+	check(err)
+	ipRate, err := strconv.ParseFloat(arguments["--ip-rate"].(string), 64)
+	check(err)
+	polite := newPoliteness(newHostLimit(siteThreads, siteRate), newHostLimit(ipThreads, ipRate))
 
-		logInfo("All threads completed.")
-		endTime := time.Now()
-		runDuration := endTime.Sub(startTime)
+	maxAttempts, err := strconv.Atoi(arguments["--max-attempts"].(string))
+	check(err)
+	retryBackoff, err := strconv.Atoi(arguments["--retry-backoff"].(string))
+	check(err)
+	retries := retryPolicy{
+		maxAttempts: maxAttempts,
+		backoff:     time.Duration(retryBackoff) * time.Second,
+	}
 
-		logGreen("Completed " + strconv.Itoa(len(uncheckedDomains)) + " domains in " + strconv.FormatFloat(runDuration.Seconds(), 'f', 2, 64) + " seconds")
-		logGreen("Total run count: " + strconv.Itoa(totalRuns))
+	leaseSeconds, err := strconv.Atoi(arguments["--lease"].(string))
+	check(err)
+	if leaseSeconds < 3 { // Renewed every third of the lease
+		logError("The lease must be at least 3 seconds.")
+		os.Exit(1)
+	}
+	leases := &leaseKeeper{
+		store:    store,
+		workerId: workerId,
+		lease:    time.Duration(leaseSeconds) * time.Second,
 	}
 
+	seenCacheSize, err := strconv.Atoi(arguments["--seen-cache"].(string))
+	check(err)
+	bloomCapacity, err := strconv.Atoi(arguments["--bloom-capacity"].(string))
+	check(err)
+	bloomFalsePositiveRate, err := strconv.ParseFloat(arguments["--bloom-fp-rate"].(string), 64)
+	check(err)
+	if bloomFalsePositiveRate <= 0 || bloomFalsePositiveRate >= 1 {
+		logError("The Bloom filter false positive rate must be between 0 and 1.")
+		os.Exit(1)
+	}
+	var bloomSnapshot string
+	if arguments["--bloom-snapshot"] != nil {
+		bloomSnapshot = arguments["--bloom-snapshot"].(string)
+	}
+	var filter *bloomFilter
+	if bloomCapacity > 0 {
+		filter = newBloomFilter(bloomCapacity, bloomFalsePositiveRate)
+		err = filter.open(ctx, store, storeOptions.Identity(), bloomSnapshot)
+		check(err)
+		filter.log()
+	}
+
+	recrawlAge, err := strconv.ParseFloat(arguments["--recrawl-age"].(string), 64)
+	check(err)
+	popularRecrawlAge, err := strconv.ParseFloat(arguments["--popular-recrawl-age"].(string), 64)
+	check(err)
+	popularInDegree, err := strconv.Atoi(arguments["--popular-in-degree"].(string))
+	check(err)
+	recrawlRatio, err := strconv.ParseFloat(arguments["--recrawl-ratio"].(string), 64)
+	check(err)
+	batches := &scheduler{
+		store:     store,
+		workerId:  workerId,
+		lease:     leases.lease,
+		batchSize: batchSize,
+		recrawl: core.RecrawlPolicy{
+			MaxAge:          time.Duration(recrawlAge * float64(time.Hour)),
+			PopularMaxAge:   time.Duration(popularRecrawlAge * float64(time.Hour)),
+			PopularInDegree: popularInDegree,
+		},
+		recrawlRatio: recrawlRatio,
+	}
+
+	// stopping ends claiming, crawling ends the requests in flight
+	stopping, stop := context.WithCancel(ctx)
+	crawling, abort := context.WithCancel(ctx)
+	defer abort()
+	go handleShutdownSignals(stop, abort)
+
+	heartbeatCtx, stopHeartbeat := context.WithCancel(ctx)
+	go leases.heartbeat(heartbeatCtx)
+	seen := newSeenCache(store, seenCacheSize)
+	seen.filter = filter
+	seen.holes = holes
+	go seen.flushPeriodically(heartbeatCtx)
+	if filter != nil && bloomSnapshot != "" {
+		go filter.snapshotPeriodically(heartbeatCtx, bloomSnapshot)
+	}
+
+	pool := newWorkerPool(crawling, stopping, stop, &crawler{
+		store:        store,
+		workerId:     workerId,
+		settings:     settings,
+		retries:      retries,
+		robots:       robots,
+		polite:       polite,
+		holes:        holes,
+		seen:         seen,
+		fingerprints: fingerprints,
+	}, leases, maxThreads, batchSize)
+	go reportThroughput(heartbeatCtx, pool)
+
+	frontier := &prefetcher{
+		batches: batches,
+		holes:   holes,
+		leases:  leases,
+		polite:  polite,
+		pool:    pool,
+	}
+	if err := frontier.run(ctx); err != nil {
+		pool.fail(err)
+	}
+
+	// Every result is saved once the workers are done
+	pool.close()
+	stopHeartbeat()
+	if server != nil {
+		server.Shutdown(ctx)
+	}
+	seen.flush(ctx)
+	pool.summary.log()
+	if filter != nil {
+		filter.log()
+		if bloomSnapshot != "" {
+			if err := filter.save(ctx, bloomSnapshot); err != nil {
+				logError("Error saving Bloom filter snapshot. " + err.Error())
+			}
+		}
+	}
+	if err := pool.failed(); err != nil {
+		store.Close()
+		os.Exit(1)
+	}
 }